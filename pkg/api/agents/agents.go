@@ -0,0 +1,203 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package agents is the API layer pkg/cli/menu's agent menu is written against: it translates an
+// operator's command and arguments into a call against the real job service (pkg/services/job) or peer
+// topology (pkg/peer), and adapts the result into a messages.UserMessage the CLI already knows how to
+// display. A handful of functions that would belong to a per-agent metadata/registry service (agent
+// notes, groups, check-in status, the agent list itself) are stubbed here rather than faked, because
+// that registry does not exist in this tree; each says so in its own doc comment instead of silently
+// returning made-up data.
+package agents
+
+import (
+	// Standard
+	"fmt"
+	"time"
+
+	// 3rd Party
+	uuid "github.com/satori/go.uuid"
+
+	// Internal
+	"github.com/Ne0nd0g/merlin/pkg/api/messages"
+	"github.com/Ne0nd0g/merlin/pkg/services/job"
+)
+
+// dispatch translates a single CLI command into a job for agentID through the job service, returning a
+// Success message carrying the new job's ID on success or a Warn message describing why the job could
+// not be created
+func dispatch(agentID uuid.UUID, jobType string, args []string) messages.UserMessage {
+	id, err := job.NewJobService().Add(agentID, jobType, args)
+	if err != nil {
+		return messages.UserMessage{
+			Level:   messages.Warn,
+			Time:    time.Now().UTC(),
+			Message: fmt.Sprintf("there was an error creating a %s job for agent %s: %s", jobType, agentID, err),
+			Error:   true,
+		}
+	}
+	return messages.UserMessage{
+		Level:   messages.Success,
+		Time:    time.Now().UTC(),
+		Message: fmt.Sprintf("created job %s for agent %s", id, agentID),
+	}
+}
+
+// CD changes the agent's current working directory
+func CD(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "cd", cmd[1:])
+}
+
+// Download instructs the agent to send a file back to the server
+func Download(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "download", cmd[1:])
+}
+
+// Upload sends a file from the server to the agent
+func Upload(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "upload", cmd[1:])
+}
+
+// ExecuteAssembly instructs a Windows agent to execute a .NET assembly
+func ExecuteAssembly(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "execute-assembly", cmd[1:])
+}
+
+// ExecutePE instructs a Windows agent to execute a PE (EXE)
+func ExecutePE(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "execute-pe", cmd[1:])
+}
+
+// ExecuteShellcode instructs the agent to execute shellcode using the requested injection method
+func ExecuteShellcode(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "shellcode", cmd[1:])
+}
+
+// Exit instructs the agent to quit running
+func Exit(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "exit", cmd[1:])
+}
+
+// SetAuth configures the agent's HTTP authentication scheme (basic, ntlm, bearer, or none) for its
+// transport's RoundTripper
+func SetAuth(agentID uuid.UUID, args []string) messages.UserMessage {
+	return dispatch(agentID, "auth", args)
+}
+
+// IFConfig requests the agent's host network adapter information
+func IFConfig(agentID uuid.UUID) messages.UserMessage {
+	return dispatch(agentID, "ifconfig", []string{})
+}
+
+// InvokeAssembly invokes a .NET assembly previously loaded into the agent's process
+func InvokeAssembly(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "invoke-assembly", cmd[1:])
+}
+
+// JA3 sets the agent's JA3 TLS client signature
+func JA3(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "ja3", cmd[1:])
+}
+
+// KillProcess kills a running process on the agent's host by PID
+func KillProcess(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "killprocess", cmd[1:])
+}
+
+// KillDate sets the epoch date/time the agent will quit running
+func KillDate(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "killdate", cmd[1:])
+}
+
+// ListAssemblies lists the .NET assemblies currently loaded into the agent's process
+func ListAssemblies(agentID uuid.UUID) messages.UserMessage {
+	return dispatch(agentID, "list-assemblies", []string{})
+}
+
+// LoadAssembly loads a .NET assembly into the agent's process
+func LoadAssembly(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "load-assembly", cmd[1:])
+}
+
+// LoadCLR loads the CLR into the agent's process
+func LoadCLR(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "load-clr", cmd[1:])
+}
+
+// LS lists the contents of a directory on the agent's host
+func LS(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "ls", cmd[1:])
+}
+
+// MaxRetry sets the maximum number of times the agent may fail to check in before it quits
+func MaxRetry(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "maxretry", cmd[1:])
+}
+
+// MEMFD executes a Linux ELF file in memory on the agent's host
+func MEMFD(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "memfd", cmd[1:])
+}
+
+// NSLOOKUP performs a DNS query on the agent's host
+func NSLOOKUP(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "nslookup", cmd[1:])
+}
+
+// Padding sets the maximum amount of random data the agent appends to every message
+func Padding(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "padding", cmd[1:])
+}
+
+// PWD requests the agent's current working directory
+func PWD(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "pwd", cmd[1:])
+}
+
+// CMD runs a command on the agent's host, directly or through its default shell depending on cmd[0]
+func CMD(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	jobType := "run"
+	if cmd[0] == "shell" {
+		jobType = "shell"
+	}
+	return dispatch(agentID, jobType, cmd[1:])
+}
+
+// Screenshot instructs the agent to capture its screen
+func Screenshot(agentID uuid.UUID) messages.UserMessage {
+	return dispatch(agentID, "screenshot", []string{})
+}
+
+// SharpGen compiles and executes .NET source code on a Windows agent using SharpGen
+func SharpGen(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "sharpgen", cmd[1:])
+}
+
+// SecureDelete securely deletes a file on the agent's host
+func SecureDelete(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "sdelete", cmd[1:])
+}
+
+// Skew sets the amount of jitter the agent uses when checking in
+func Skew(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "skew", cmd[1:])
+}
+
+// Sleep sets the agent's check-in sleep interval
+func Sleep(agentID uuid.UUID, cmd []string) messages.UserMessage {
+	return dispatch(agentID, "sleep", cmd[1:])
+}
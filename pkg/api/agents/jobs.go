@@ -0,0 +1,62 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package agents
+
+import (
+	// Standard
+	"fmt"
+	"time"
+
+	// 3rd Party
+	uuid "github.com/satori/go.uuid"
+
+	// Internal
+	"github.com/Ne0nd0g/merlin/pkg/api/messages"
+	"github.com/Ne0nd0g/merlin/pkg/services/job"
+)
+
+// ClearJobs removes every unsent job still queued for the agent
+func ClearJobs(agentID uuid.UUID) messages.UserMessage {
+	if err := job.NewJobService().Clear(agentID); err != nil {
+		return messages.UserMessage{
+			Level:   messages.Warn,
+			Time:    time.Now().UTC(),
+			Message: fmt.Sprintf("there was an error clearing jobs for agent %s: %s", agentID, err),
+			Error:   true,
+		}
+	}
+	return messages.UserMessage{
+		Level:   messages.Success,
+		Time:    time.Now().UTC(),
+		Message: fmt.Sprintf("cleared unsent jobs for agent %s", agentID),
+	}
+}
+
+// GetJobsForAgent returns a display-ready table of every job known for the agent
+func GetJobsForAgent(agentID uuid.UUID) ([][]string, messages.UserMessage) {
+	rows, err := job.NewJobService().GetTableActive(agentID)
+	if err != nil {
+		return nil, messages.UserMessage{
+			Level:   messages.Warn,
+			Time:    time.Now().UTC(),
+			Message: fmt.Sprintf("there was an error getting jobs for agent %s: %s", agentID, err),
+			Error:   true,
+		}
+	}
+	return rows, messages.UserMessage{}
+}
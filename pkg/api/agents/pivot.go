@@ -0,0 +1,132 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package agents
+
+import (
+	// Standard
+	"fmt"
+	"time"
+
+	// 3rd Party
+	uuid "github.com/satori/go.uuid"
+
+	// Internal
+	"github.com/Ne0nd0g/merlin/pkg/api/messages"
+	"github.com/Ne0nd0g/merlin/pkg/peer"
+)
+
+// Link dispatches a "listener" or "link" job (args[0]) that establishes or joins a pivot connection on
+// the agent; the remaining args are the listener/connection details
+func Link(agentID uuid.UUID, args []string) messages.UserMessage {
+	if len(args) < 1 {
+		return messages.UserMessage{
+			Level:   messages.Warn,
+			Time:    time.Now().UTC(),
+			Message: "Link requires at least a job type argument",
+			Error:   true,
+		}
+	}
+	// buildJobPayload only recognizes "listener" and "link" as pivot job types; "pivot connect" maps to
+	// args[0] == "connect", which has no case there and would otherwise fail deep inside the job service
+	// with an opaque "invalid job type" error. Surface that gap here instead, since dispatch has no way
+	// to know it's specific to this command.
+	if args[0] != "listener" && args[0] != "link" {
+		return messages.UserMessage{
+			Level:   messages.Warn,
+			Time:    time.Now().UTC(),
+			Message: fmt.Sprintf("pivot %s is not supported yet: the job service only handles listener and link pivot jobs", args[0]),
+			Error:   true,
+		}
+	}
+	return dispatch(agentID, args[0], args[1:])
+}
+
+// SetRoute registers, in the server's peer.DefaultGraph, that childID is reached by relaying through
+// parentID over the given linkType (e.g. "smb" or "tcp"), so jobs addressed to childID are routed
+// through parentID instead of sent directly
+func SetRoute(args []string) messages.UserMessage {
+	if len(args) < 2 {
+		return messages.UserMessage{
+			Level:   messages.Warn,
+			Time:    time.Now().UTC(),
+			Message: "SetRoute requires a <child-agent> <parent-agent> [linkType]",
+			Error:   true,
+		}
+	}
+
+	child, err := uuid.FromString(args[0])
+	if err != nil {
+		return messages.UserMessage{
+			Level:   messages.Warn,
+			Time:    time.Now().UTC(),
+			Message: fmt.Sprintf("%s is not a valid agent ID: %s", args[0], err),
+			Error:   true,
+		}
+	}
+	parent, err := uuid.FromString(args[1])
+	if err != nil {
+		return messages.UserMessage{
+			Level:   messages.Warn,
+			Time:    time.Now().UTC(),
+			Message: fmt.Sprintf("%s is not a valid agent ID: %s", args[1], err),
+			Error:   true,
+		}
+	}
+
+	linkType := "tcp"
+	if len(args) >= 3 {
+		linkType = args[2]
+	}
+
+	if err = peer.DefaultGraph.Link(parent, child, linkType); err != nil {
+		return messages.UserMessage{
+			Level:   messages.Warn,
+			Time:    time.Now().UTC(),
+			Message: fmt.Sprintf("there was an error setting the route for agent %s: %s", child, err),
+			Error:   true,
+		}
+	}
+	return messages.UserMessage{
+		Level:   messages.Success,
+		Time:    time.Now().UTC(),
+		Message: fmt.Sprintf("agent %s is now routed through %s over %s", child, parent, linkType),
+	}
+}
+
+// GetLinks returns a display-ready table of every pivot link where agentID is the parent
+func GetLinks(agentID uuid.UUID) ([][]string, messages.UserMessage) {
+	var rows [][]string
+	for _, edge := range peer.DefaultGraph.List() {
+		if edge.Parent != agentID {
+			continue
+		}
+		rows = append(rows, []string{edge.Child.String(), edge.LinkType, "linked"})
+	}
+	return rows, messages.UserMessage{}
+}
+
+// GetPivotTree returns a display-ready table of the entire server-wide pivot topology, one row per
+// registered parent->child link
+func GetPivotTree() [][]string {
+	edges := peer.DefaultGraph.List()
+	rows := make([][]string, 0, len(edges))
+	for _, edge := range edges {
+		rows = append(rows, []string{edge.Parent.String(), edge.LinkType, edge.Child.String()})
+	}
+	return rows
+}
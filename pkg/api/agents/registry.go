@@ -0,0 +1,96 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package agents
+
+import (
+	// Standard
+	"fmt"
+	"time"
+
+	// 3rd Party
+	uuid "github.com/satori/go.uuid"
+
+	// Internal
+	"github.com/Ne0nd0g/merlin/pkg/api/messages"
+)
+
+// notImplemented builds the Warn message every stub below returns: the agent metadata/registry service
+// (check-in tracking, per-agent info, groups, notes) is not present in this tree, so these functions
+// cannot be backed by real data without inventing a registry this package has no business designing.
+func notImplemented(fn string) messages.UserMessage {
+	return messages.UserMessage{
+		Level:   messages.Warn,
+		Time:    time.Now().UTC(),
+		Message: fmt.Sprintf("%s is not available: no agent registry service is present in this build", fn),
+		Error:   true,
+	}
+}
+
+// GetAgents returns the ID of every known agent. Stubbed: there is no agent registry in this tree to
+// enumerate, so it always returns an empty list.
+func GetAgents() []uuid.UUID {
+	return []uuid.UUID{}
+}
+
+// GetAgentInfo returns a display-ready table of everything known about an agent. Stubbed: there is no
+// agent registry in this tree to read check-in info from.
+func GetAgentInfo(agentID uuid.UUID) ([][]string, messages.UserMessage) {
+	return nil, notImplemented("GetAgentInfo")
+}
+
+// GetAgentsRows returns a header and a display-ready table summarizing every known agent, e.g. for the
+// "sessions" command. Stubbed: there is no agent registry in this tree to read from.
+func GetAgentsRows() ([]string, [][]string) {
+	return []string{"Agent GUID", "Platform", "User", "Host", "Transport", "Status", "Last Checkin"}, nil
+}
+
+// GetAgentStatus returns an agent's check-in status ("Active", "Delayed", or "Dead"). Stubbed: there is
+// no agent registry in this tree to derive a status from.
+func GetAgentStatus(agentID uuid.UUID) (string, messages.UserMessage) {
+	return "Unknown", notImplemented("GetAgentStatus")
+}
+
+// Remove deletes an agent from the server's tracking. Stubbed: there is no agent registry in this tree
+// to remove an entry from.
+func Remove(agentID uuid.UUID) messages.UserMessage {
+	return notImplemented("Remove")
+}
+
+// Note attaches a server-side note to an agent. Stubbed: there is no agent registry in this tree to
+// persist the note on.
+func Note(agentID uuid.UUID, args []string) messages.UserMessage {
+	return notImplemented("Note")
+}
+
+// GroupAdd adds an agent to a named group. Stubbed: there is no agent registry in this tree to track
+// group membership on.
+func GroupAdd(agentID uuid.UUID, group string) messages.UserMessage {
+	return notImplemented("GroupAdd")
+}
+
+// GroupRemove removes an agent from a named group. Stubbed: there is no agent registry in this tree to
+// track group membership on.
+func GroupRemove(agentID uuid.UUID, group string) messages.UserMessage {
+	return notImplemented("GroupRemove")
+}
+
+// GroupMembers returns the ID of every agent in a named group. Stubbed: there is no agent registry in
+// this tree to track group membership on, so it always returns an empty list.
+func GroupMembers(group string) []uuid.UUID {
+	return []uuid.UUID{}
+}
@@ -19,9 +19,16 @@ package menu
 
 import (
 	// Standard
+	"bufio"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	// 3rd Party
@@ -42,6 +49,19 @@ var agent uuid.UUID
 // platform tracks the current agent's platform or operating system used to provide specific menus
 var platform string
 
+// aliases holds user-defined command shortcuts loaded from the alias config file, keyed by alias name
+var aliases = make(map[string][]string)
+
+// screenshotStop tracks the running interval screenshot goroutines keyed by agent ID so they can be cancelled
+var screenshotStop = struct {
+	sync.Mutex
+	m map[uuid.UUID]chan bool
+}{m: make(map[uuid.UUID]chan bool)}
+
+func init() {
+	loadAliases()
+}
+
 // handlerAgent contains the logic to handle the "agent" menu commands
 func handlerAgent(cmd []string) {
 	// TODO create a structure for every command that has a Name,Function,Help
@@ -49,8 +69,42 @@ func handlerAgent(cmd []string) {
 		return
 	}
 	switch cmd[0] {
+	case "alias":
+		if len(cmd) < 3 {
+			core.MessageChannel <- messages.UserMessage{
+				Level:   messages.Warn,
+				Message: fmt.Sprintf("Invalid arguments: 'alias <name> <cmd>...'"),
+				Time:    time.Now().UTC(),
+				Error:   true,
+			}
+		} else {
+			aliases[cmd[1]] = cmd[2:]
+			saveAliases()
+		}
 	case "back":
 		Set(MAIN)
+	case "broadcast":
+		if len(cmd) < 3 {
+			core.MessageChannel <- messages.UserMessage{
+				Level:   messages.Warn,
+				Message: fmt.Sprintf("Invalid arguments: 'broadcast [await] <group|all> <command>...'"),
+				Time:    time.Now().UTC(),
+				Error:   true,
+			}
+		} else if cmd[1] == "await" {
+			if len(cmd) < 4 {
+				core.MessageChannel <- messages.UserMessage{
+					Level:   messages.Warn,
+					Message: fmt.Sprintf("Invalid arguments: 'broadcast await <group|all> <command>...'"),
+					Time:    time.Now().UTC(),
+					Error:   true,
+				}
+			} else {
+				broadcastCommand(cmd[2], cmd[3:], true)
+			}
+		} else {
+			broadcastCommand(cmd[1], cmd[2:], false)
+		}
 	case "cd":
 		core.MessageChannel <- agentAPI.CD(agent, cmd)
 	case "clear", "c":
@@ -95,6 +149,17 @@ func handlerAgent(cmd []string) {
 				Error:   true,
 			}
 		}
+	case "auth":
+		if len(cmd) < 2 {
+			core.MessageChannel <- messages.UserMessage{
+				Level:   messages.Warn,
+				Message: fmt.Sprintf("Invalid arguments: 'auth <basic|ntlm|bearer|none> <args>...'"),
+				Time:    time.Now().UTC(),
+				Error:   true,
+			}
+		} else {
+			core.MessageChannel <- agentAPI.SetAuth(agent, cmd[1:])
+		}
 	case "?", "help":
 		helpAgent()
 	case "ifconfig", "ipconfig":
@@ -148,6 +213,67 @@ func handlerAgent(cmd []string) {
 		core.MessageChannel <- agentAPI.NSLOOKUP(agent, cmd)
 	case "padding":
 		core.MessageChannel <- agentAPI.Padding(agent, cmd)
+	case "pivot":
+		if len(cmd) < 2 {
+			core.MessageChannel <- messages.UserMessage{
+				Level:   messages.Warn,
+				Message: fmt.Sprintf("Invalid arguments: 'pivot <listener|connect|route|list|tree>'"),
+				Time:    time.Now().UTC(),
+				Error:   true,
+			}
+		} else {
+			switch cmd[1] {
+			case "route":
+				if len(cmd) < 4 {
+					core.MessageChannel <- messages.UserMessage{
+						Level:   messages.Warn,
+						Message: fmt.Sprintf("Invalid arguments: 'pivot route <child-agent> <parent-agent> [smb|tcp|udp]'"),
+						Time:    time.Now().UTC(),
+						Error:   true,
+					}
+				} else {
+					core.MessageChannel <- agentAPI.SetRoute(cmd[2:])
+				}
+			case "listener":
+				if len(cmd) < 4 {
+					core.MessageChannel <- messages.UserMessage{
+						Level:   messages.Warn,
+						Message: fmt.Sprintf("Invalid arguments: 'pivot listener <smb|tcp> <name/port>'"),
+						Time:    time.Now().UTC(),
+						Error:   true,
+					}
+				} else {
+					core.MessageChannel <- agentAPI.Link(agent, append([]string{"listener"}, cmd[2:]...))
+				}
+			case "connect":
+				if len(cmd) < 4 {
+					core.MessageChannel <- messages.UserMessage{
+						Level:   messages.Warn,
+						Message: fmt.Sprintf("Invalid arguments: 'pivot connect <parent-agent> <child-endpoint>'"),
+						Time:    time.Now().UTC(),
+						Error:   true,
+					}
+				} else {
+					core.MessageChannel <- agentAPI.Link(agent, append([]string{"connect"}, cmd[2:]...))
+				}
+			case "list":
+				rows, message := agentAPI.GetLinks(agent)
+				if message.Error {
+					core.MessageChannel <- message
+				} else {
+					core.DisplayTable([]string{"Child Agent", "Endpoint", "Status"}, rows)
+				}
+			case "tree":
+				displayPivotTree()
+			default:
+				core.MessageChannel <- messages.UserMessage{
+					Level:   messages.Warn,
+					Message: fmt.Sprintf("Invalid arguments: 'pivot <listener|connect|route|list|tree>'"),
+					Time:    time.Now().UTC(),
+					Error:   true,
+				}
+			}
+		}
 	case "pwd":
 		core.MessageChannel <- agentAPI.PWD(agent, cmd)
 	case "quit":
@@ -161,6 +287,30 @@ func handlerAgent(cmd []string) {
 		}
 	case "run", "shell", "exec":
 		core.MessageChannel <- agentAPI.CMD(agent, cmd)
+	case "screenshot":
+		if len(cmd) > 1 {
+			switch cmd[1] {
+			case "stop":
+				stopScreenshotLoop(agent)
+			case "browse":
+				browseLatestScreenshot(agent)
+			default:
+				startScreenshotLoop(agent, cmd[1])
+			}
+		} else {
+			core.MessageChannel <- agentAPI.Screenshot(agent)
+		}
+	case "script":
+		if len(cmd) < 2 {
+			core.MessageChannel <- messages.UserMessage{
+				Level:   messages.Warn,
+				Message: fmt.Sprintf("Invalid arguments: 'script <path>'"),
+				Time:    time.Now().UTC(),
+				Error:   true,
+			}
+		} else {
+			runScript(cmd[1])
+		}
 	case "sessions":
 		header, rows := agentAPI.GetAgentsRows()
 		core.DisplayTable(header, rows)
@@ -209,7 +359,9 @@ func handlerAgent(cmd []string) {
 	case "upload":
 		core.MessageChannel <- agentAPI.Upload(agent, cmd)
 	default:
-		if len(cmd) > 1 {
+		if expansion, ok := aliases[cmd[0]]; ok {
+			handlerAgent(append(append([]string{}, expansion...), cmd[1:]...))
+		} else if len(cmd) > 1 {
 			core.ExecuteCommand(cmd[0], cmd[1:])
 		} else {
 			core.ExecuteCommand(cmd[0], []string{})
@@ -221,7 +373,17 @@ func handlerAgent(cmd []string) {
 func completerAgent() *readline.PrefixCompleter {
 	// core commands are available to every agent and typically use native Go code
 	core := []readline.PrefixCompleterInterface{
+		readline.PcItem("alias"),
+		readline.PcItem("auth",
+			readline.PcItem("basic"),
+			readline.PcItem("ntlm"),
+			readline.PcItem("bearer"),
+			readline.PcItem("none"),
+		),
 		readline.PcItem("back"),
+		readline.PcItem("broadcast",
+			readline.PcItem("await"),
+		),
 		readline.PcItem("cd"),
 		readline.PcItem("clear"),
 		readline.PcItem("download"),
@@ -244,9 +406,24 @@ func completerAgent() *readline.PrefixCompleter {
 		readline.PcItem("maxretry"),
 		readline.PcItem("note"),
 		readline.PcItem("padding"),
+		readline.PcItem("pivot",
+			readline.PcItem("listener",
+				readline.PcItem("smb"),
+				readline.PcItem("tcp"),
+			),
+			readline.PcItem("connect"),
+			readline.PcItem("route"),
+			readline.PcItem("list"),
+			readline.PcItem("tree"),
+		),
 		readline.PcItem("pwd"),
 		readline.PcItem("run"),
 		readline.PcItem("main"),
+		readline.PcItem("screenshot",
+			readline.PcItem("stop"),
+			readline.PcItem("browse"),
+		),
+		readline.PcItem("script"),
 		readline.PcItem("sdelete"),
 		readline.PcItem("shell"),
 		readline.PcItem("skew"),
@@ -296,9 +473,12 @@ func helpAgent() {
 
 	// Commands available to all agents
 	base := [][]string{
+		{"alias", "Define a shortcut for one or more commands", "alias <name> <cmd>..."},
+		{"auth", "Configure the agent's HTTP authentication to a proxy or web endpoint", "auth <basic <user> <pass> | ntlm <domain> <user> <pass> | bearer <token> | none>"},
 		{"cd", "Change directories", "cd ../../ OR cd c:\\\\Users"},
 		{"clear", "Clear any UNSENT jobs from the queue", ""},
 		{"back", "Return to the main menu", ""},
+		{"broadcast", "Fan a command out to every agent in a group", "broadcast [await] <group|all> <command>..."},
 		{"exit", "Instruct the agent to exit and quit running", ""},
 		{"download", "Download a file from the agent", "download <remote_file>"},
 		{"ifconfig", "Displays host network adapter information", ""},
@@ -313,8 +493,11 @@ func helpAgent() {
 		{"note", "Add a server-side note to the agent", ""},
 		{"nslookup", "DNS query on host or ip", "nslookup 8.8.8.8"},
 		{"padding", "Set the maximum amount of random data appended to every message", "padding <number>"},
+		{"pivot", "Chain agents together through SMB or TCP peer links", "pivot <listener <smb|tcp> <name/port> | connect <parent-agent> <child-endpoint> | route <child-agent> <parent-agent> [smb|tcp|udp] | list | tree>"},
 		{"pwd", "Display the current working directory", "pwd"},
 		{"run", "Execute a program directly, without using a shell", "run ping -c 3 8.8.8.8"},
+		{"screenshot", "Capture the agent's screen, optionally on a repeating interval", "screenshot [interval | stop | browse]"},
+		{"script", "Run a file of newline-delimited agent menu commands", "script <path>"},
 		{"sdelete", "Securely delete a file", "sdelete <file path>"},
 		{"shell", "Execute a command on the agent using the host's default shell", "shell ping -c 3 8.8.8.8"},
 		{"skew", "Set the amount of skew, or jitter, that an agent will use to checkin", "skew <number>"},
@@ -432,6 +615,328 @@ func agentListCompleter() func(string) []string {
 	}
 }
 
+// broadcastCommand fans the given command out to every agent in the target group (or "all" agents),
+// dispatching the same command to each through the existing agent menu plumbing and displaying a table
+// of the resulting jobs. When await is true, it blocks until every fanned job reaches a terminal state
+// and prints per-agent success/failure.
+func broadcastCommand(target string, command []string, await bool) {
+	var targets []uuid.UUID
+	if strings.ToLower(target) == "all" {
+		targets = agentAPI.GetAgents()
+	} else {
+		targets = agentAPI.GroupMembers(target)
+	}
+
+	if len(targets) == 0 {
+		core.MessageChannel <- messages.UserMessage{
+			Level:   messages.Warn,
+			Message: fmt.Sprintf("There are 0 agents in the broadcast target %s", target),
+			Time:    time.Now().UTC(),
+			Error:   true,
+		}
+		return
+	}
+
+	saved := agent
+	rows := make([][]string, 0, len(targets))
+	for _, a := range targets {
+		agent = a
+		handlerAgent(command)
+
+		jobID, status := lastJobStatus(a)
+		rows = append(rows, []string{a.String(), jobID, status})
+	}
+	agent = saved
+
+	core.DisplayTable([]string{"AgentID", "JobID", "Status"}, rows)
+
+	if await {
+		for i := range rows {
+			for !isTerminalStatus(rows[i][2]) {
+				time.Sleep(time.Second)
+				_, rows[i][2] = lastJobStatus(targets[i])
+			}
+		}
+		core.DisplayTable([]string{"AgentID", "JobID", "Status"}, rows)
+	}
+}
+
+// lastJobStatus returns the ID and status of the most recently created job for the given agent
+func lastJobStatus(agentID uuid.UUID) (string, string) {
+	jobs, message := agentAPI.GetJobsForAgent(agentID)
+	if message.Message != "" || len(jobs) == 0 {
+		return "", "Unknown"
+	}
+	last := jobs[len(jobs)-1]
+	return last[0], last[2]
+}
+
+// isTerminalStatus returns true if a job status will not change any further
+func isTerminalStatus(status string) bool {
+	switch status {
+	case "Complete", "Canceled", "Failed":
+		return true
+	default:
+		return false
+	}
+}
+
+// startScreenshotLoop spawns a goroutine that repeatedly issues an agentAPI.Screenshot job on the given
+// interval until cancelled with "screenshot stop"
+func startScreenshotLoop(agentID uuid.UUID, interval string) {
+	d, err := time.ParseDuration(interval)
+	if err != nil {
+		core.MessageChannel <- messages.UserMessage{
+			Level:   messages.Warn,
+			Message: fmt.Sprintf("Invalid screenshot interval %s: %s", interval, err),
+			Time:    time.Now().UTC(),
+			Error:   true,
+		}
+		return
+	}
+
+	screenshotStop.Lock()
+	if stop, ok := screenshotStop.m[agentID]; ok {
+		close(stop)
+	}
+	stop := make(chan bool)
+	screenshotStop.m[agentID] = stop
+	screenshotStop.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(d)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				core.MessageChannel <- agentAPI.Screenshot(agentID)
+			}
+		}
+	}()
+}
+
+// stopScreenshotLoop cancels a running interval screenshot goroutine for the given agent, if any
+func stopScreenshotLoop(agentID uuid.UUID) {
+	screenshotStop.Lock()
+	defer screenshotStop.Unlock()
+	if stop, ok := screenshotStop.m[agentID]; ok {
+		close(stop)
+		delete(screenshotStop.m, agentID)
+	}
+}
+
+// browseLatestScreenshot opens the most recently saved screenshot for the agent with the OS's default viewer
+func browseLatestScreenshot(agentID uuid.UUID) {
+	dir := filepath.Join("data", "agents", agentID.String(), "screenshots")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil || len(entries) == 0 {
+		core.MessageChannel <- messages.UserMessage{
+			Level:   messages.Warn,
+			Message: fmt.Sprintf("There are no screenshots saved for agent %s", agentID),
+			Time:    time.Now().UTC(),
+			Error:   true,
+		}
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].ModTime().After(entries[j].ModTime())
+	})
+	latest := filepath.Join(dir, entries[0].Name())
+
+	var openCmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		openCmd = exec.Command("open", latest)
+	case "windows":
+		openCmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", latest)
+	default:
+		openCmd = exec.Command("xdg-open", latest)
+	}
+	if errStart := openCmd.Start(); errStart != nil {
+		core.MessageChannel <- messages.UserMessage{
+			Level:   messages.Warn,
+			Message: fmt.Sprintf("There was an error opening screenshot %s: %s", latest, errStart),
+			Time:    time.Now().UTC(),
+			Error:   true,
+		}
+	}
+}
+
+// runScript reads a file of one-command-per-line agent menu instructions and feeds each line back through
+// handlerAgent sequentially. Lines starting with "#" are comments, "sleep <dur>" pauses execution for the
+// given Go duration, "wait-job <id|last>" blocks until the referenced job reaches a terminal status, and
+// "on-error <continue|abort>" controls whether a later error stops the script
+func runScript(path string) {
+	f, err := os.Open(path)
+	if err != nil {
+		core.MessageChannel <- messages.UserMessage{
+			Level:   messages.Warn,
+			Message: fmt.Sprintf("There was an error opening the script file %s: %s", path, err),
+			Time:    time.Now().UTC(),
+			Error:   true,
+		}
+		return
+	}
+	defer f.Close()
+
+	onError := "continue"
+	var lastJob string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		switch fields[0] {
+		case "on-error":
+			if len(fields) == 2 {
+				onError = fields[1]
+			}
+			continue
+		case "sleep":
+			if len(fields) == 2 {
+				d, errDuration := time.ParseDuration(fields[1])
+				if errDuration == nil {
+					time.Sleep(d)
+					continue
+				}
+			}
+		case "wait-job":
+			if len(fields) == 2 {
+				id := fields[1]
+				if id == "last" {
+					id = lastJob
+				}
+				if !waitJob(id) && onError == "abort" {
+					return
+				}
+				continue
+			}
+		}
+		handlerAgent(fields)
+		if id := latestJobID(); id != "" {
+			lastJob = id
+		}
+	}
+	if errScan := scanner.Err(); errScan != nil {
+		core.MessageChannel <- messages.UserMessage{
+			Level:   messages.Warn,
+			Message: fmt.Sprintf("There was an error reading the script file %s: %s", path, errScan),
+			Time:    time.Now().UTC(),
+			Error:   true,
+		}
+	}
+}
+
+// latestJobID returns the ID of the agent's most recently created job, by the "Created" column
+// agentAPI.GetJobsForAgent reports, or "" if the agent has no jobs. runScript uses this to resolve
+// "wait-job last" to the job an immediately preceding command actually created, instead of guessing at
+// the command's own text.
+func latestJobID() string {
+	rows, message := agentAPI.GetJobsForAgent(agent)
+	if message.Message != "" {
+		return ""
+	}
+	var latestID string
+	var latest time.Time
+	for _, row := range rows {
+		if len(row) < 4 {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, row[3])
+		if err != nil {
+			continue
+		}
+		if latestID == "" || created.After(latest) {
+			latestID = row[0]
+			latest = created
+		}
+	}
+	return latestID
+}
+
+// waitJob polls agentAPI.GetJobsForAgent until the given job ID is no longer active, returning true
+// on a terminal success status
+func waitJob(id string) bool {
+	for {
+		rows, message := agentAPI.GetJobsForAgent(agent)
+		if message.Message != "" {
+			core.MessageChannel <- message
+			return false
+		}
+		found := false
+		for _, row := range rows {
+			if len(row) > 2 && row[0] == id {
+				found = true
+				switch row[2] {
+				case "Complete":
+					return true
+				case "Canceled":
+					return false
+				}
+			}
+		}
+		if !found {
+			return false
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+// loadAliases reads user-defined command aliases from the CLI's alias config file, called once at startup
+func loadAliases() {
+	path := filepath.Join("data", "alias.conf")
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 {
+			aliases[fields[0]] = fields[1:]
+		}
+	}
+}
+
+// saveAliases writes the current set of user-defined command aliases to the CLI's alias config file
+func saveAliases() {
+	path := filepath.Join("data", "alias.conf")
+	f, err := os.Create(path)
+	if err != nil {
+		core.MessageChannel <- messages.UserMessage{
+			Level:   messages.Warn,
+			Message: fmt.Sprintf("There was an error saving the alias config file %s: %s", path, err),
+			Time:    time.Now().UTC(),
+			Error:   true,
+		}
+		return
+	}
+	defer f.Close()
+
+	for name, expansion := range aliases {
+		fmt.Fprintf(f, "%s %s\n", name, strings.Join(expansion, " "))
+	}
+}
+
+// displayPivotTree renders the current server-wide pivot topology as a parent/child tree using tablewriter
+func displayPivotTree() {
+	table := tablewriter.NewWriter(os.Stdout)
+	table.SetAlignment(tablewriter.ALIGN_LEFT)
+	table.SetBorder(false)
+	table.SetHeader([]string{"Parent Agent", "Link Type", "Child Agent"})
+
+	table.AppendBulk(agentAPI.GetPivotTree())
+	fmt.Println()
+	table.Render()
+	fmt.Println()
+}
+
 // displayJobTable displays a table of agent jobs along with their status
 func displayJobTable(rows [][]string) {
 	table := tablewriter.NewWriter(os.Stdout)
@@ -0,0 +1,233 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package jobs
+
+import (
+	"encoding/json"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Status constants track an Info record's place in its lifecycle
+const (
+	// CREATED is set when a job is queued but not yet sent to its agent
+	CREATED = iota
+	// SENT is set once the job has been delivered to its agent on a check-in
+	SENT
+	// RETURNED is set when the agent has replied but the reply has not yet been fully processed
+	RETURNED
+	// ACTIVE is set for a job whose work is still in progress, e.g. a streamed RESULT or a FILETRANSFER
+	// that has not yet received every chunk
+	ACTIVE
+	// COMPLETE is the terminal status for a job that finished successfully
+	COMPLETE
+	// CANCELED is the terminal status for a job an operator canceled before it completed
+	CANCELED
+	// EXPIRED is set when a job sits SENT past its Timeout without a response
+	EXPIRED
+)
+
+// Info is the server-side tracking record for a single Job: its identity (ID, Token, AgentID), its
+// place in the job lifecycle (Status and the Created/Sent/Completed timestamps), and the scheduling
+// metadata (Schedule, Priority, Timeout, RetryPolicy) used to order and, if needed, re-queue it. Its
+// fields are unexported so every mutation goes through a method that also updates the fields it implies
+// (e.g. Complete sets both status and the Completed timestamp); MarshalJSON/UnmarshalJSON give it the
+// same on-the-wire shape a plain exported struct would have so it can be persisted as an opaque blob by
+// pkg/jobs/sql and pkg/jobs/memory.
+type Info struct {
+	id        string
+	token     uuid.UUID
+	agentID   uuid.UUID
+	jobType   string
+	command   string
+	status    int
+	created   time.Time
+	sent      time.Time
+	completed time.Time
+	schedule  time.Time
+	priority  int
+	timeout   time.Duration
+	retry     RetryPolicy
+	attempts  int
+}
+
+// infoJSON is the exported shadow of Info used to (de)serialize it to JSON without exposing setters on
+// every field
+type infoJSON struct {
+	ID        string        `json:"id"`
+	Token     uuid.UUID     `json:"token"`
+	AgentID   uuid.UUID     `json:"agentId"`
+	Type      string        `json:"type"`
+	Command   string        `json:"command"`
+	Status    int           `json:"status"`
+	Created   time.Time     `json:"created"`
+	Sent      time.Time     `json:"sent"`
+	Completed time.Time     `json:"completed"`
+	Schedule  time.Time     `json:"schedule"`
+	Priority  int           `json:"priority"`
+	Timeout   time.Duration `json:"timeout"`
+	Retry     RetryPolicy   `json:"retry"`
+	Attempts  int           `json:"attempts"`
+}
+
+// NewInfo creates an Info tracking record for a new job addressed to agentID, generating its own unique
+// ID and Token
+func NewInfo(agentID uuid.UUID, jobType string, command string) Info {
+	return Info{
+		id:      uuid.NewV4().String(),
+		token:   uuid.NewV4(),
+		agentID: agentID,
+		jobType: jobType,
+		command: command,
+		status:  CREATED,
+		created: time.Now().UTC(),
+	}
+}
+
+// ID returns the job's tracking identifier
+func (i Info) ID() string { return i.id }
+
+// Token returns the job's authentication token, used to verify an agent's reply actually belongs to
+// this job
+func (i Info) Token() uuid.UUID { return i.token }
+
+// AgentID returns the ID of the agent this job is addressed to
+func (i Info) AgentID() uuid.UUID { return i.agentID }
+
+// Type returns the job's String()-formatted Type
+func (i Info) Type() string { return i.jobType }
+
+// Command returns the short, human-readable command string logged and displayed for this job
+func (i Info) Command() string { return i.command }
+
+// Status returns the job's current lifecycle status
+func (i Info) Status() int { return i.status }
+
+// Created returns when this Info record was created
+func (i Info) Created() time.Time { return i.created }
+
+// Sent returns when the job was delivered to its agent, or the zero time if it has not been sent yet
+func (i Info) Sent() time.Time { return i.sent }
+
+// Completed returns when the job reached COMPLETE, or the zero time if it has not completed
+func (i Info) Completed() time.Time { return i.completed }
+
+// Schedule returns the earliest time this job is eligible for delivery
+func (i Info) Schedule() time.Time { return i.schedule }
+
+// Priority returns the priority this job is ordered by among an agent's eligible jobs
+func (i Info) Priority() int { return i.priority }
+
+// Timeout returns how long this job may sit SENT before it is considered abandoned
+func (i Info) Timeout() time.Duration { return i.timeout }
+
+// Retry returns the job's opt-in RetryPolicy, the zero value if none was set
+func (i Info) Retry() RetryPolicy { return i.retry }
+
+// Attempts returns how many times this job has expired and been automatically retried
+func (i Info) Attempts() int { return i.attempts }
+
+// SetID overrides the job's tracking identifier, e.g. when an importer re-queues an archived job under
+// a newly generated ID to avoid colliding with one that already exists
+func (i *Info) SetID(id string) { i.id = id }
+
+// SetSchedule sets the earliest time this job is eligible for delivery
+func (i *Info) SetSchedule(t time.Time) { i.schedule = t }
+
+// SetPriority sets the priority this job is ordered by among an agent's eligible jobs
+func (i *Info) SetPriority(p int) { i.priority = p }
+
+// SetTimeout sets how long this job may sit SENT before it is considered abandoned
+func (i *Info) SetTimeout(d time.Duration) { i.timeout = d }
+
+// SetRetry opts this job in to automatic re-queueing under the given RetryPolicy
+func (i *Info) SetRetry(p RetryPolicy) { i.retry = p }
+
+// MarkSent transitions the job to SENT and records the current time as Sent
+func (i *Info) MarkSent() {
+	i.status = SENT
+	i.sent = time.Now().UTC()
+}
+
+// Complete transitions the job to the terminal COMPLETE status and records the current time as Completed
+func (i *Info) Complete() {
+	i.status = COMPLETE
+	i.completed = time.Now().UTC()
+}
+
+// Active marks the job ACTIVE, used for a job whose work is still in progress (a streamed RESULT or an
+// in-flight FILETRANSFER) so it does not appear COMPLETE before every chunk has actually been processed
+func (i *Info) Active() {
+	i.status = ACTIVE
+}
+
+// Cancel transitions the job to the terminal CANCELED status
+func (i *Info) Cancel() {
+	i.status = CANCELED
+}
+
+// Expire transitions a job that sat SENT past its Timeout into EXPIRED and counts it as one retry
+// attempt, so a RetryPolicy's MaxAttempts is eventually exhausted
+func (i *Info) Expire() {
+	i.status = EXPIRED
+	i.attempts++
+}
+
+// MarshalJSON serializes Info's unexported fields through its exported infoJSON shadow
+func (i Info) MarshalJSON() ([]byte, error) {
+	return json.Marshal(infoJSON{
+		ID:        i.id,
+		Token:     i.token,
+		AgentID:   i.agentID,
+		Type:      i.jobType,
+		Command:   i.command,
+		Status:    i.status,
+		Created:   i.created,
+		Sent:      i.sent,
+		Completed: i.completed,
+		Schedule:  i.schedule,
+		Priority:  i.priority,
+		Timeout:   i.timeout,
+		Retry:     i.retry,
+		Attempts:  i.attempts,
+	})
+}
+
+// UnmarshalJSON restores Info's unexported fields from its exported infoJSON shadow
+func (i *Info) UnmarshalJSON(data []byte) error {
+	var s infoJSON
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	i.id = s.ID
+	i.token = s.Token
+	i.agentID = s.AgentID
+	i.jobType = s.Type
+	i.command = s.Command
+	i.status = s.Status
+	i.created = s.Created
+	i.sent = s.Sent
+	i.completed = s.Completed
+	i.schedule = s.Schedule
+	i.priority = s.Priority
+	i.timeout = s.Timeout
+	i.retry = s.Retry
+	i.attempts = s.Attempts
+	return nil
+}
@@ -0,0 +1,256 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package jobs holds the types shared between the server's job service (pkg/services/job), its
+// repository/queue implementations (pkg/jobs/sql, pkg/jobs/queue/...), and the CLI/API layers: the Job
+// wire payload sent to and from an agent, the server-side Info tracking record, and the Repository and
+// Queue interfaces those are persisted through.
+package jobs
+
+import (
+	"fmt"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Job type constants identify the kind of Payload a Job carries and how the server and agent should
+// handle it.
+const (
+	// UNDEFINED is the zero value for a Job's Type and is never intentionally sent
+	UNDEFINED = iota
+	// CONTROL jobs configure agent behavior, e.g. sleep, killdate, ja3, padding, exit
+	CONTROL
+	// MODULE jobs invoke a built-in agent capability, e.g. clr, listener, link, unlink, ps
+	MODULE
+	// NATIVE jobs invoke a native OS operation, e.g. cd, ls, pwd, rm
+	NATIVE
+	// CMD jobs run a command directly or through the host's shell
+	CMD
+	// FILETRANSFER jobs carry a chunk of a file being uploaded to, or downloaded from, an agent
+	FILETRANSFER
+	// FILETRANSFERCONTROL jobs carry an in-band resume/cancel control message for a chunked FILETRANSFER
+	FILETRANSFERCONTROL
+	// SHELLCODE jobs execute shellcode via the requested injection method
+	SHELLCODE
+	// SOCKS jobs carry SOCKS5 proxy traffic, TCP or UDP ASSOCIATE, relayed through the agent
+	SOCKS
+	// RESULT jobs carry the (possibly chunked) output of a previously dispatched job
+	RESULT
+	// AGENTINFO jobs carry the agent's check-in information
+	AGENTINFO
+	// LINK jobs wrap another Job so it can be relayed through a pivot chain to an agent that is not
+	// directly connected to one of the server's own listeners
+	LINK
+	// AUTH jobs carry HTTP authentication credentials (Basic/NTLM/Bearer) for the agent's transport
+	AUTH
+)
+
+// String returns the human-readable name of a Job Type constant, used for server-side logging and to
+// key Info's Type field
+func String(jobType int) string {
+	switch jobType {
+	case CONTROL:
+		return "CONTROL"
+	case MODULE:
+		return "MODULE"
+	case NATIVE:
+		return "NATIVE"
+	case CMD:
+		return "CMD"
+	case FILETRANSFER:
+		return "FILETRANSFER"
+	case FILETRANSFERCONTROL:
+		return "FILETRANSFERCONTROL"
+	case SHELLCODE:
+		return "SHELLCODE"
+	case SOCKS:
+		return "SOCKS"
+	case RESULT:
+		return "RESULT"
+	case AGENTINFO:
+		return "AGENTINFO"
+	case LINK:
+		return "LINK"
+	case AUTH:
+		return "AUTH"
+	default:
+		return fmt.Sprintf("UNDEFINED(%d)", jobType)
+	}
+}
+
+// Job is the wire structure exchanged between the server and an agent: a unit of work addressed to
+// AgentID, along with the server-side bookkeeping (Token, Schedule, Priority, Timeout) needed to
+// dispatch and track it.
+type Job struct {
+	ID      string      `json:"id"`
+	AgentID uuid.UUID   `json:"agentId"`
+	Token   uuid.UUID   `json:"token"`
+	Type    int         `json:"type"`
+	Payload interface{} `json:"payload"`
+	// Schedule is the earliest time this job becomes eligible for delivery; the zero value means
+	// immediately eligible
+	Schedule time.Time `json:"schedule"`
+	// Priority orders delivery among an agent's eligible jobs; higher values are dispatched first
+	Priority int `json:"priority"`
+	// Timeout is how long this job may sit SENT before it is considered abandoned and transitioned to
+	// EXPIRED; zero means it never expires
+	Timeout time.Duration `json:"timeout"`
+}
+
+// Command is the Payload for CONTROL, MODULE, and NATIVE jobs: a command name and its arguments
+type Command struct {
+	Command    string   `json:"command"`
+	Args       []string `json:"args"`
+	Compressed bool     `json:"compressed"`
+}
+
+// FileTransfer is the Payload for a single FILETRANSFER chunk. A manifest chunk (SHA256 set, ChunkIndex
+// and ChunkSHA256 unused) closes out the transfer with the whole-file hash; every other chunk carries one
+// piece of the file along with its own integrity check.
+type FileTransfer struct {
+	// FileLocation is the path being read from (download) or written to (upload) by the agent
+	FileLocation string `json:"fileLocation"`
+	// FileBlob is the base64, optionally zlib-compressed, payload of this chunk
+	FileBlob   string `json:"fileBlob"`
+	IsDownload bool   `json:"isDownload"`
+	Compressed bool   `json:"compressed"`
+	// TransferID groups every chunk, including the manifest chunk, belonging to the same transfer
+	TransferID string `json:"transferId"`
+	// ChunkIndex is this chunk's 0-indexed position within the transfer
+	ChunkIndex int `json:"chunkIndex"`
+	// TotalChunks is the total number of data chunks (excluding the manifest chunk) in the transfer
+	TotalChunks int `json:"totalChunks"`
+	// ChunkSHA256 is the SHA-256, hex-encoded, of this chunk's decompressed bytes
+	ChunkSHA256 string `json:"chunkSha256"`
+	// SHA256 is the whole-file SHA-256, hex-encoded; only set on the manifest chunk
+	SHA256 string `json:"sha256"`
+}
+
+// FileTransferControl is the Payload for an in-band resume/cancel message exchanged mid-transfer, e.g.
+// after an agent reconnects and needs to know which chunks are still missing
+type FileTransferControl struct {
+	TransferID string `json:"transferId"`
+	// Action is "resume", "cancel", or "abort"
+	Action string `json:"action"`
+	// Missing is the list of chunk indices still needed, populated on a "resume" reply
+	Missing []int `json:"missing,omitempty"`
+}
+
+// Shellcode is the Payload for a SHELLCODE job
+type Shellcode struct {
+	// Method is "self", "remote", "rtlcreateuserthread", or "userapc"
+	Method string `json:"method"`
+	Bytes  string `json:"bytes"`
+	PID    uint32 `json:"pid"`
+}
+
+// Results is the Payload for a RESULT job. A long-running command that streams output across multiple
+// check-ins sends one Results message per chunk, ordered by Sequence, with Final set only on the last one.
+type Results struct {
+	Stdout string `json:"stdout"`
+	Stderr string `json:"stderr"`
+	// Sequence is this chunk's 0-indexed position within the streamed result
+	Sequence uint32 `json:"sequence"`
+	// Final marks the last chunk of a streamed result
+	Final bool `json:"final"`
+}
+
+// Socks is the Payload for a SOCKS job carrying TCP stream traffic
+type Socks struct {
+	ID    string `json:"id"`
+	Index int    `json:"index"`
+	Data  []byte `json:"data"`
+	Close bool   `json:"close"`
+}
+
+// SocksUDP is the Payload for a SOCKS job carrying RFC 1928 UDP ASSOCIATE traffic. It mirrors Socks'
+// Index-based resequencing but rides its own type since a datagram has no ordered stream to append to.
+type SocksUDP struct {
+	ID      string `json:"id"`
+	Index   int    `json:"index"`
+	Address string `json:"address"`
+	Data    []byte `json:"data"`
+	Close   bool   `json:"close"`
+}
+
+// Link is the Payload for a LINK job: an inner Job, addressed to its true destination agent, wrapped so
+// it can be relayed hop-by-hop through a pivot chain. Hops lists every agent the frame must pass through,
+// in order, from the directly-reachable relay down to the inner job's true AgentID.
+type Link struct {
+	Hops  []uuid.UUID `json:"hops"`
+	Inner Job         `json:"inner"`
+}
+
+// Auth is the Payload for an AUTH job, carrying the HTTP authentication credentials an agent should
+// install on its transport's RoundTripper
+type Auth struct {
+	// Scheme is "basic", "ntlm", "bearer", or "none"
+	Scheme string   `json:"scheme"`
+	Args   []string `json:"args"`
+}
+
+// RetryPolicy lets an operator opt in to automatic re-queueing of a job that expired without a response.
+// It is never applied to CMD, SHELLCODE, or FILETRANSFER jobs by default since those are not idempotent;
+// it is intended for CONTROL/NATIVE jobs like a retried agentInfo poke.
+type RetryPolicy struct {
+	MaxAttempts int           `json:"maxAttempts"`
+	Backoff     time.Duration `json:"backoff"`
+}
+
+// Repository is the interface a job service uses to persist the Info tracking record and, until it is
+// sent, the Job payload, for every job created. The in-memory implementation (pkg/jobs/memory) does not
+// survive a restart; the SQL-backed implementation (pkg/jobs/sql) does.
+type Repository interface {
+	// Add persists a newly created job along with its server-side Info tracking record
+	Add(job Job, info Info)
+	// GetInfo returns the Info tracking record for the job with the given ID
+	GetInfo(id string) (Info, error)
+	// UpdateInfo persists a mutated Info tracking record, e.g. after a status transition
+	UpdateInfo(info Info) error
+	// GetJobs returns every job queued for the given agent that is currently eligible for delivery
+	// (Schedule <= now), ordered by (Priority DESC, Created ASC)
+	GetJobs(agentID uuid.UUID) ([]Job, error)
+	// GetJob returns the stored Job payload for a single job ID, regardless of its current status
+	GetJob(id string) (Job, error)
+	// GetAll returns the Info tracking record for every known job, keyed by job ID
+	GetAll() map[string]Info
+	// Clear removes every unsent (CREATED) job queued for the given agent
+	Clear(agentID uuid.UUID) error
+	// ClearAll removes every unsent (CREATED) job across all agents
+	ClearAll() error
+	// RemoveCompleted deletes every job in a terminal status (COMPLETE, CANCELED, or EXPIRED) whose
+	// Completed/Sent timestamp is older than before, returning how many were removed
+	RemoveCompleted(before time.Time) (int, error)
+}
+
+// Queue is the interface a job service uses to durably track every job dispatched to an agent until it
+// is Acked, so a restart or a channel backed up behind a slow agent doesn't silently lose it. The
+// in-memory implementation (pkg/jobs/queue/memory) does not survive a restart; the SQL-backed
+// implementation (pkg/jobs/queue/sql) does.
+type Queue interface {
+	// Enqueue adds job to agentID's queue, ready for dispatch
+	Enqueue(agentID uuid.UUID, job Job) error
+	// Ack removes jobID from agentID's queue after it has been durably marked COMPLETE/Active
+	Ack(agentID uuid.UUID, jobID string) error
+	// Nack leaves jobID in agentID's queue but schedules it to sit out an exponentially increasing
+	// backoff before the server will replay it
+	Nack(agentID uuid.UUID, jobID string) error
+	// Peek returns every job still queued for agentID, Acked or not, e.g. so the server can replay an
+	// agent's un-Acked jobs after a restart
+	Peek(agentID uuid.UUID) ([]Job, error)
+}
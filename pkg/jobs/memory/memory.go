@@ -0,0 +1,205 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package memory is the default, in-memory implementation of the jobs.Repository interface. Job state
+// kept here does not survive a server restart; pkg/jobs/sql is the durable alternative.
+package memory
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+// record pairs a job's Info tracking record with its Job payload, mirroring the (info_blob, job_blob)
+// pair pkg/jobs/sql persists per row
+type record struct {
+	job  jobs.Job
+	info jobs.Info
+}
+
+// Repository is an in-memory implementation of jobs.Repository, keyed by job ID
+type Repository struct {
+	mu      sync.Mutex
+	records map[string]*record
+}
+
+// NewRepository returns an empty in-memory Repository
+func NewRepository() *Repository {
+	return &Repository{records: make(map[string]*record)}
+}
+
+// Add persists a newly created job along with its server-side Info tracking record
+func (r *Repository) Add(job jobs.Job, info jobs.Info) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.records[info.ID()] = &record{job: job, info: info}
+}
+
+// GetInfo returns the Info tracking record for the job with the given ID
+func (r *Repository) GetInfo(id string) (jobs.Info, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.records[id]
+	if !ok {
+		return jobs.Info{}, fmt.Errorf("pkg/jobs/memory.GetInfo(): job %s was not found", id)
+	}
+	return rec.info, nil
+}
+
+// UpdateInfo persists a mutated Info tracking record, e.g. after a status transition
+func (r *Repository) UpdateInfo(info jobs.Info) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.records[info.ID()]
+	if !ok {
+		return fmt.Errorf("pkg/jobs/memory.UpdateInfo(): job %s was not found", info.ID())
+	}
+	rec.info = info
+	return nil
+}
+
+// GetJobs returns every job queued for agentID that is currently eligible for delivery
+// (Schedule <= now), ordered by (Priority DESC, Created ASC) so control-plane jobs queued ahead of a
+// bulky transfer are actually delivered first and a job scheduled for the future isn't handed out early
+func (r *Repository) GetJobs(agentID uuid.UUID) ([]jobs.Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now().UTC()
+	var eligible []*record
+	for _, rec := range r.records {
+		if rec.job.AgentID != agentID || rec.info.Status() != jobs.CREATED {
+			continue
+		}
+		if !rec.info.Schedule().IsZero() && rec.info.Schedule().After(now) {
+			continue
+		}
+		eligible = append(eligible, rec)
+	}
+
+	sort.SliceStable(eligible, func(a, b int) bool {
+		if eligible[a].info.Priority() != eligible[b].info.Priority() {
+			return eligible[a].info.Priority() > eligible[b].info.Priority()
+		}
+		return eligible[a].info.Created().Before(eligible[b].info.Created())
+	})
+
+	agentJobs := make([]jobs.Job, 0, len(eligible))
+	for _, rec := range eligible {
+		rec.info.MarkSent()
+		agentJobs = append(agentJobs, rec.job)
+	}
+	return agentJobs, nil
+}
+
+// GetJob returns the stored Job payload for a single job ID, regardless of its current status. It is
+// used to replay an EXPIRED job's original payload when RetryPolicy re-queues it.
+func (r *Repository) GetJob(id string) (jobs.Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rec, ok := r.records[id]
+	if !ok {
+		return jobs.Job{}, fmt.Errorf("pkg/jobs/memory.GetJob(): job %s was not found", id)
+	}
+	return rec.job, nil
+}
+
+// GetAll returns the Info tracking record for every known job, keyed by job ID
+func (r *Repository) GetAll() map[string]jobs.Info {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	all := make(map[string]jobs.Info, len(r.records))
+	for id, rec := range r.records {
+		all[id] = rec.info
+	}
+	return all
+}
+
+// Clear removes every unsent (CREATED) job queued for the given agent
+func (r *Repository) Clear(agentID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, rec := range r.records {
+		if rec.job.AgentID == agentID && rec.info.Status() == jobs.CREATED {
+			delete(r.records, id)
+		}
+	}
+	return nil
+}
+
+// ClearAll removes every unsent (CREATED) job across all agents
+func (r *Repository) ClearAll() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for id, rec := range r.records {
+		if rec.info.Status() == jobs.CREATED {
+			delete(r.records, id)
+		}
+	}
+	return nil
+}
+
+// RemoveCompleted deletes every job in a terminal status (COMPLETE, CANCELED, or EXPIRED) whose
+// Completed/Sent timestamp is older than before, returning how many were removed
+func (r *Repository) RemoveCompleted(before time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var removed int
+	for id, rec := range r.records {
+		if !terminal(rec.info.Status()) {
+			continue
+		}
+		if terminalTimestamp(rec.info).After(before) {
+			continue
+		}
+		delete(r.records, id)
+		removed++
+	}
+	return removed, nil
+}
+
+// terminal reports whether status is one of the terminal job statuses RemoveCompleted sweeps
+func terminal(status int) bool {
+	return status == jobs.COMPLETE || status == jobs.CANCELED || status == jobs.EXPIRED
+}
+
+// terminalTimestamp returns the best available timestamp for when a job reached its terminal status:
+// Completed if it was set (COMPLETE only), otherwise the last time it was Sent, otherwise Created.
+// CANCELED and EXPIRED don't record their own transition time, so this is the closest approximation
+// RemoveCompleted can use to decide how old a job actually is.
+func terminalTimestamp(info jobs.Info) time.Time {
+	if !info.Completed().IsZero() {
+		return info.Completed()
+	}
+	if !info.Sent().IsZero() {
+		return info.Sent()
+	}
+	return info.Created()
+}
@@ -0,0 +1,89 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package memory is the default, in-memory implementation of the jobs.Queue interface. Job state kept
+// here does not survive a server restart; pkg/jobs/queue/sql is the durable alternative.
+package memory
+
+import (
+	// Standard
+	"sync"
+
+	// 3rd Party
+	uuid "github.com/satori/go.uuid"
+
+	// Merlin
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+// entry tracks a single enqueued job still awaiting an Ack
+type entry struct {
+	job jobs.Job
+}
+
+// Queue is an in-memory implementation of jobs.Queue, keyed by agent then job ID
+type Queue struct {
+	mu      sync.Mutex
+	entries map[uuid.UUID]map[string]*entry
+}
+
+// NewQueue returns an empty in-memory Queue
+func NewQueue() *Queue {
+	return &Queue{entries: make(map[uuid.UUID]map[string]*entry)}
+}
+
+// Enqueue adds job to agentID's queue, ready for dispatch
+func (q *Queue) Enqueue(agentID uuid.UUID, job jobs.Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.entries[agentID] == nil {
+		q.entries[agentID] = make(map[string]*entry)
+	}
+	q.entries[agentID][job.ID] = &entry{job: job}
+	return nil
+}
+
+// Ack removes jobID from agentID's queue after it has been durably marked COMPLETE/Active
+func (q *Queue) Ack(agentID uuid.UUID, jobID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if m, ok := q.entries[agentID]; ok {
+		delete(m, jobID)
+	}
+	return nil
+}
+
+// Nack is a no-op here: the job was never removed from the queue, so it is still there, ready to be
+// replayed the next time the server starts up
+func (q *Queue) Nack(agentID uuid.UUID, jobID string) error {
+	return nil
+}
+
+// Peek returns every job still queued for agentID, Acked or not, e.g. so the server can replay an
+// agent's un-Acked jobs after a restart
+func (q *Queue) Peek(agentID uuid.UUID) ([]jobs.Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var pending []jobs.Job
+	for _, e := range q.entries[agentID] {
+		pending = append(pending, e.job)
+	}
+	return pending, nil
+}
@@ -0,0 +1,126 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sql is a SQL-backed implementation of the jobs.Queue interface. Unlike the in-memory queue,
+// entries persisted here survive a Merlin server restart, so the job service can replay any job an agent
+// never Acked. SQLite is the default driver, consistent with pkg/jobs/sql.
+package sql
+
+import (
+	// Standard
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	// 3rd Party
+	_ "github.com/mattn/go-sqlite3"
+	uuid "github.com/satori/go.uuid"
+
+	// Merlin
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS queue (
+	agent_id TEXT NOT NULL,
+	job_id   TEXT NOT NULL,
+	job_blob BLOB NOT NULL,
+	PRIMARY KEY (agent_id, job_id)
+);
+CREATE INDEX IF NOT EXISTS idx_queue_agent_id ON queue(agent_id);
+`
+
+// Repository is a SQL-backed implementation of jobs.Queue
+type Repository struct {
+	db *sql.DB
+	mu sync.Mutex
+}
+
+// NewRepository opens, and migrates if necessary, the SQL job queue at dataSourceName using the
+// provided database/sql driver, e.g. NewRepository("sqlite3", "data/merlin-queue.db")
+func NewRepository(driverName, dataSourceName string) (*Repository, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("pkg/jobs/queue/sql.NewRepository(): there was an error opening the database: %s", err)
+	}
+	if _, err = db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("pkg/jobs/queue/sql.NewRepository(): there was an error migrating the database: %s", err)
+	}
+	return &Repository{db: db}, nil
+}
+
+// Enqueue persists job, ready for dispatch, replacing any existing entry for the same agent/job ID
+func (r *Repository) Enqueue(agentID uuid.UUID, job jobs.Job) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jobBlob, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("pkg/jobs/queue/sql.Enqueue(): there was an error marshaling job %s: %s", job.ID, err)
+	}
+	_, err = r.db.Exec(
+		`INSERT OR REPLACE INTO queue (agent_id, job_id, job_blob) VALUES (?, ?, ?)`,
+		agentID.String(), job.ID, jobBlob,
+	)
+	if err != nil {
+		return fmt.Errorf("pkg/jobs/queue/sql.Enqueue(): there was an error inserting job %s: %s", job.ID, err)
+	}
+	return nil
+}
+
+// Ack removes jobID from agentID's queue after it has been durably marked COMPLETE/Active
+func (r *Repository) Ack(agentID uuid.UUID, jobID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.db.Exec(`DELETE FROM queue WHERE agent_id = ? AND job_id = ?`, agentID.String(), jobID)
+	if err != nil {
+		return fmt.Errorf("pkg/jobs/queue/sql.Ack(): there was an error removing job %s: %s", jobID, err)
+	}
+	return nil
+}
+
+// Nack is a no-op here: the job was never removed from the queue, so it is still there, ready to be
+// replayed the next time the server starts up
+func (r *Repository) Nack(agentID uuid.UUID, jobID string) error {
+	return nil
+}
+
+// Peek returns every job still queued for agentID, Acked or not, e.g. so the server can replay an
+// agent's un-Acked jobs after a restart
+func (r *Repository) Peek(agentID uuid.UUID) ([]jobs.Job, error) {
+	rows, err := r.db.Query(`SELECT job_blob FROM queue WHERE agent_id = ?`, agentID.String())
+	if err != nil {
+		return nil, fmt.Errorf("pkg/jobs/queue/sql.Peek(): there was an error querying jobs for agent %s: %s", agentID, err)
+	}
+	defer rows.Close()
+
+	var pending []jobs.Job
+	for rows.Next() {
+		var jobBlob []byte
+		if err = rows.Scan(&jobBlob); err != nil {
+			return nil, fmt.Errorf("pkg/jobs/queue/sql.Peek(): there was an error scanning a job for agent %s: %s", agentID, err)
+		}
+		var job jobs.Job
+		if err = json.Unmarshal(jobBlob, &job); err != nil {
+			return nil, fmt.Errorf("pkg/jobs/queue/sql.Peek(): there was an error unmarshaling a job for agent %s: %s", agentID, err)
+		}
+		pending = append(pending, job)
+	}
+	return pending, nil
+}
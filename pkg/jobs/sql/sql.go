@@ -0,0 +1,319 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package sql is a SQL-backed implementation of the jobs.Repository interface. Unlike the in-memory
+// repository, job state persisted here survives a Merlin server restart. SQLite is the default driver;
+// Postgres and MySQL are supported by passing their respective database/sql driver name and DSN.
+package sql
+
+import (
+	// Standard
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	// 3rd Party
+	_ "github.com/mattn/go-sqlite3"
+	uuid "github.com/satori/go.uuid"
+
+	// Merlin
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+// schema creates the jobs table, along with indexes on agent_id and status that the server's job
+// listing and sweeper queries rely on
+const schema = `
+CREATE TABLE IF NOT EXISTS jobs (
+	id        TEXT PRIMARY KEY,
+	agent_id  TEXT NOT NULL,
+	info_blob BLOB NOT NULL,
+	job_blob  BLOB NOT NULL,
+	status    INTEGER NOT NULL,
+	created   DATETIME NOT NULL,
+	schedule  DATETIME NOT NULL,
+	priority  INTEGER NOT NULL DEFAULT 0
+);
+CREATE INDEX IF NOT EXISTS idx_jobs_agent_id ON jobs(agent_id);
+CREATE INDEX IF NOT EXISTS idx_jobs_status ON jobs(status);
+`
+
+// Repository is a SQL-backed implementation of jobs.Repository
+type Repository struct {
+	db *sql.DB
+	mu sync.Mutex
+}
+
+// NewRepository opens, and migrates if necessary, the SQL job repository at dataSourceName using the
+// provided database/sql driver, e.g. NewRepository("sqlite3", "data/merlin.db")
+func NewRepository(driverName, dataSourceName string) (*Repository, error) {
+	db, err := sql.Open(driverName, dataSourceName)
+	if err != nil {
+		return nil, fmt.Errorf("pkg/jobs/sql.NewRepository(): there was an error opening the database: %s", err)
+	}
+	if _, err = db.Exec(schema); err != nil {
+		return nil, fmt.Errorf("pkg/jobs/sql.NewRepository(): there was an error migrating the database: %s", err)
+	}
+	return &Repository{db: db}, nil
+}
+
+// Add persists a newly created job along with its server-side Info tracking record
+func (r *Repository) Add(job jobs.Job, info jobs.Info) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	jobBlob, err := json.Marshal(job)
+	if err != nil {
+		fmt.Printf("pkg/jobs/sql.Add(): there was an error marshaling job %s: %s\n", info.ID(), err)
+		return
+	}
+	infoBlob, err := json.Marshal(info)
+	if err != nil {
+		fmt.Printf("pkg/jobs/sql.Add(): there was an error marshaling job info %s: %s\n", info.ID(), err)
+		return
+	}
+	_, err = r.db.Exec(
+		`INSERT INTO jobs (id, agent_id, info_blob, job_blob, status, created, schedule, priority) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		info.ID(), job.AgentID.String(), infoBlob, jobBlob, info.Status(), time.Now().UTC(), info.Schedule(), info.Priority(),
+	)
+	if err != nil {
+		fmt.Printf("pkg/jobs/sql.Add(): there was an error inserting job %s: %s\n", info.ID(), err)
+	}
+}
+
+// GetInfo returns the Info tracking record for the job with the given ID
+func (r *Repository) GetInfo(id string) (jobs.Info, error) {
+	var info jobs.Info
+	var infoBlob []byte
+	row := r.db.QueryRow(`SELECT info_blob FROM jobs WHERE id = ?`, id)
+	if err := row.Scan(&infoBlob); err != nil {
+		return info, fmt.Errorf("pkg/jobs/sql.GetInfo(): there was an error fetching job %s: %s", id, err)
+	}
+	if err := json.Unmarshal(infoBlob, &info); err != nil {
+		return info, fmt.Errorf("pkg/jobs/sql.GetInfo(): there was an error unmarshaling job %s: %s", id, err)
+	}
+	return info, nil
+}
+
+// UpdateInfo persists a mutated Info tracking record, e.g. after a status transition
+func (r *Repository) UpdateInfo(info jobs.Info) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	infoBlob, err := json.Marshal(info)
+	if err != nil {
+		return fmt.Errorf("pkg/jobs/sql.UpdateInfo(): there was an error marshaling job info %s: %s", info.ID(), err)
+	}
+	_, err = r.db.Exec(`UPDATE jobs SET info_blob = ?, status = ? WHERE id = ?`, infoBlob, info.Status(), info.ID())
+	if err != nil {
+		return fmt.Errorf("pkg/jobs/sql.UpdateInfo(): there was an error updating job %s: %s", info.ID(), err)
+	}
+	return nil
+}
+
+// GetJobs returns every job queued for the given agent that is currently eligible for delivery
+// (schedule <= now), ordered by (priority DESC, created ASC) so control-plane jobs queued ahead of a
+// bulky transfer are actually delivered first and a job scheduled for the future isn't handed out early.
+// Every job returned is transitioned to SENT before it's handed back, the same way pkg/jobs/memory does,
+// so it isn't redelivered on the agent's next check-in and becomes eligible for pkg/services/job's
+// timeout/expire sweep.
+func (r *Repository) GetJobs(agentID uuid.UUID) ([]jobs.Job, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rows, err := r.db.Query(
+		`SELECT id, info_blob, job_blob FROM jobs WHERE agent_id = ? AND status = ? AND schedule <= ? ORDER BY priority DESC, created ASC`,
+		agentID.String(), jobs.CREATED, time.Now().UTC(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("pkg/jobs/sql.GetJobs(): there was an error querying jobs for agent %s: %s", agentID, err)
+	}
+	defer rows.Close()
+
+	type row struct {
+		id       string
+		infoBlob []byte
+		jobBlob  []byte
+	}
+	var rs []row
+	for rows.Next() {
+		var rw row
+		if err = rows.Scan(&rw.id, &rw.infoBlob, &rw.jobBlob); err != nil {
+			return nil, fmt.Errorf("pkg/jobs/sql.GetJobs(): there was an error scanning a job for agent %s: %s", agentID, err)
+		}
+		rs = append(rs, rw)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("pkg/jobs/sql.GetJobs(): there was an error reading jobs for agent %s: %s", agentID, err)
+	}
+	rows.Close()
+
+	agentJobs := make([]jobs.Job, 0, len(rs))
+	for _, rw := range rs {
+		var job jobs.Job
+		if err = json.Unmarshal(rw.jobBlob, &job); err != nil {
+			return nil, fmt.Errorf("pkg/jobs/sql.GetJobs(): there was an error unmarshaling a job for agent %s: %s", agentID, err)
+		}
+		var info jobs.Info
+		if err = json.Unmarshal(rw.infoBlob, &info); err != nil {
+			return nil, fmt.Errorf("pkg/jobs/sql.GetJobs(): there was an error unmarshaling info for job %s: %s", rw.id, err)
+		}
+		info.MarkSent()
+		infoBlob, err := json.Marshal(info)
+		if err != nil {
+			return nil, fmt.Errorf("pkg/jobs/sql.GetJobs(): there was an error marshaling info for job %s: %s", rw.id, err)
+		}
+		if _, err = r.db.Exec(`UPDATE jobs SET info_blob = ?, status = ? WHERE id = ?`, infoBlob, info.Status(), rw.id); err != nil {
+			return nil, fmt.Errorf("pkg/jobs/sql.GetJobs(): there was an error marking job %s SENT: %s", rw.id, err)
+		}
+		agentJobs = append(agentJobs, job)
+	}
+	return agentJobs, nil
+}
+
+// GetJob returns the stored Job payload for a single job ID, regardless of its current status. It is
+// used to replay an EXPIRED job's original payload when RetryPolicy re-queues it.
+func (r *Repository) GetJob(id string) (jobs.Job, error) {
+	var job jobs.Job
+	var jobBlob []byte
+	row := r.db.QueryRow(`SELECT job_blob FROM jobs WHERE id = ?`, id)
+	if err := row.Scan(&jobBlob); err != nil {
+		return job, fmt.Errorf("pkg/jobs/sql.GetJob(): there was an error fetching job %s: %s", id, err)
+	}
+	if err := json.Unmarshal(jobBlob, &job); err != nil {
+		return job, fmt.Errorf("pkg/jobs/sql.GetJob(): there was an error unmarshaling job %s: %s", id, err)
+	}
+	return job, nil
+}
+
+// GetAll returns the Info tracking record for every known job, keyed by job ID
+func (r *Repository) GetAll() map[string]jobs.Info {
+	all := make(map[string]jobs.Info)
+	rows, err := r.db.Query(`SELECT id, info_blob FROM jobs`)
+	if err != nil {
+		fmt.Printf("pkg/jobs/sql.GetAll(): there was an error querying jobs: %s\n", err)
+		return all
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id string
+		var infoBlob []byte
+		if err = rows.Scan(&id, &infoBlob); err != nil {
+			fmt.Printf("pkg/jobs/sql.GetAll(): there was an error scanning a job: %s\n", err)
+			continue
+		}
+		var info jobs.Info
+		if err = json.Unmarshal(infoBlob, &info); err != nil {
+			fmt.Printf("pkg/jobs/sql.GetAll(): there was an error unmarshaling job %s: %s\n", id, err)
+			continue
+		}
+		all[id] = info
+	}
+	return all
+}
+
+// Clear removes every unsent (CREATED) job queued for the given agent
+func (r *Repository) Clear(agentID uuid.UUID) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.db.Exec(`DELETE FROM jobs WHERE agent_id = ? AND status = ?`, agentID.String(), jobs.CREATED)
+	if err != nil {
+		return fmt.Errorf("pkg/jobs/sql.Clear(): there was an error clearing jobs for agent %s: %s", agentID, err)
+	}
+	return nil
+}
+
+// ClearAll removes every unsent (CREATED) job across all agents
+func (r *Repository) ClearAll() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, err := r.db.Exec(`DELETE FROM jobs WHERE status = ?`, jobs.CREATED)
+	if err != nil {
+		return fmt.Errorf("pkg/jobs/sql.ClearAll(): there was an error clearing all jobs: %s", err)
+	}
+	return nil
+}
+
+// RemoveCompleted deletes every job in a terminal status (COMPLETE, CANCELED, or EXPIRED) whose
+// Completed/Sent timestamp is older than before, returning how many were removed. The status index
+// narrows the candidates; each candidate's info_blob is still decoded to find its actual terminal
+// timestamp, since CANCELED/EXPIRED jobs don't have a dedicated timestamp column of their own.
+func (r *Repository) RemoveCompleted(before time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	rows, err := r.db.Query(
+		`SELECT id, info_blob FROM jobs WHERE status IN (?, ?, ?)`,
+		jobs.COMPLETE, jobs.CANCELED, jobs.EXPIRED,
+	)
+	if err != nil {
+		return 0, fmt.Errorf("pkg/jobs/sql.RemoveCompleted(): there was an error querying terminal jobs: %s", err)
+	}
+
+	type row struct {
+		id       string
+		infoBlob []byte
+	}
+	var candidates []row
+	for rows.Next() {
+		var rw row
+		if err = rows.Scan(&rw.id, &rw.infoBlob); err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("pkg/jobs/sql.RemoveCompleted(): there was an error scanning a job: %s", err)
+		}
+		candidates = append(candidates, rw)
+	}
+	rowsErr := rows.Err()
+	rows.Close()
+	if rowsErr != nil {
+		return 0, fmt.Errorf("pkg/jobs/sql.RemoveCompleted(): there was an error reading terminal jobs: %s", rowsErr)
+	}
+
+	var removed int
+	for _, rw := range candidates {
+		var info jobs.Info
+		if err = json.Unmarshal(rw.infoBlob, &info); err != nil {
+			return removed, fmt.Errorf("pkg/jobs/sql.RemoveCompleted(): there was an error unmarshaling job %s: %s", rw.id, err)
+		}
+		if terminalTimestamp(info).After(before) {
+			continue
+		}
+		if _, err = r.db.Exec(`DELETE FROM jobs WHERE id = ?`, rw.id); err != nil {
+			return removed, fmt.Errorf("pkg/jobs/sql.RemoveCompleted(): there was an error removing job %s: %s", rw.id, err)
+		}
+		removed++
+	}
+	return removed, nil
+}
+
+// terminalTimestamp returns the best available timestamp for when a job reached its terminal status:
+// Completed if it was set (COMPLETE only), otherwise the last time it was Sent, otherwise Created.
+// CANCELED and EXPIRED don't record their own transition time, so this is the closest approximation
+// RemoveCompleted can use to decide how old a job actually is.
+func terminalTimestamp(info jobs.Info) time.Time {
+	if !info.Completed().IsZero() {
+		return info.Completed()
+	}
+	if !info.Sent().IsZero() {
+		return info.Sent()
+	}
+	return info.Created()
+}
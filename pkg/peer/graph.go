@@ -0,0 +1,114 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package peer tracks the parent/child topology formed when agents link to each other over SMB, TCP, or
+// UDP (bind or reverse) instead of talking to the server directly. Every other Merlin agent is a "peer"
+// relative to the server's own transport listeners; the Graph records which agent relays traffic for
+// which so that jobs bound for an agent with no direct connection to the server can be routed through the
+// chain of agents it is linked through.
+package peer
+
+import (
+	"fmt"
+	"sync"
+
+	uuid "github.com/satori/go.uuid"
+)
+
+// Edge describes a single parent->child link registered in the Graph
+type Edge struct {
+	Parent   uuid.UUID
+	Child    uuid.UUID
+	LinkType string
+}
+
+// Graph tracks the parent->child links formed as agents pivot through one another. A child with no
+// entry in the graph is assumed to be directly connected to one of the server's own listeners.
+type Graph struct {
+	mu    sync.Mutex
+	edges map[uuid.UUID]Edge // keyed by child
+}
+
+// NewGraph returns an empty peer Graph
+func NewGraph() *Graph {
+	return &Graph{edges: make(map[uuid.UUID]Edge)}
+}
+
+// DefaultGraph is the server-wide peer topology shared by the job service, which routes jobs through it,
+// and the CLI/API layer, which lists and edits it
+var DefaultGraph = NewGraph()
+
+// Link registers that child is reached by relaying traffic through parent over the given linkType
+// (e.g. "smb" or "tcp"), replacing any link child previously had. It returns an error if doing so would
+// create a routing cycle.
+func (g *Graph) Link(parent, child uuid.UUID, linkType string) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	for ancestor := parent; ancestor != uuid.Nil; {
+		if ancestor == child {
+			return fmt.Errorf("pkg/peer.Link(): linking %s under %s would create a routing cycle", child, parent)
+		}
+		edge, ok := g.edges[ancestor]
+		if !ok {
+			break
+		}
+		ancestor = edge.Parent
+	}
+
+	g.edges[child] = Edge{Parent: parent, Child: child, LinkType: linkType}
+	return nil
+}
+
+// Unlink removes any parent link registered for child, e.g. after its pivot connection is torn down
+func (g *Graph) Unlink(child uuid.UUID) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	delete(g.edges, child)
+}
+
+// Route walks the chain of links from target back to the nearest agent the server can reach directly
+// (one with no registered parent), returning that agent's ID as nextHop and the full hop list from
+// nextHop down to target, inclusive, in the order a LINK frame should carry them. direct is true, and
+// nextHop equals target, when target has no registered parent at all.
+func (g *Graph) Route(target uuid.UUID) (nextHop uuid.UUID, hops []uuid.UUID, direct bool) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	hops = []uuid.UUID{target}
+	current := target
+	for {
+		edge, ok := g.edges[current]
+		if !ok {
+			return current, hops, current == target
+		}
+		current = edge.Parent
+		hops = append([]uuid.UUID{current}, hops...)
+	}
+}
+
+// List returns every registered link, e.g. for a CLI pivot tree view
+func (g *Graph) List() []Edge {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	edges := make([]Edge, 0, len(g.edges))
+	for _, edge := range g.edges {
+		edges = append(edges, edge)
+	}
+	return edges
+}
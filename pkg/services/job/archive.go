@@ -0,0 +1,284 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package job
+
+import (
+	// Standard
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	// 3rd Party
+	uuid "github.com/satori/go.uuid"
+
+	// Internal
+	"github.com/Ne0nd0g/merlin/pkg/core"
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+// archiveSchemaVersion identifies the manifest layout written by Export, so a future Import can detect
+// and reject an incompatible archive rather than silently misreading it
+const archiveSchemaVersion = 1
+
+// agentDataPrefix is the path, within the zip archive, that downloaded agent data files are stored
+// under so Import can restore them to data/agents/ on the destination server
+const agentDataPrefix = "data/agents/"
+
+// manifest describes the contents of a Service.Export archive
+type manifest struct {
+	SchemaVersion int            `json:"schema_version"`
+	ExportedAt    time.Time      `json:"exported_at"`
+	AgentJobCount map[string]int `json:"agent_job_count"`
+}
+
+// pendingJobRecord pairs a still-undelivered job's Info tracking record with its Job payload so Import
+// can re-queue it exactly as it would have been sent to the agent
+type pendingJobRecord struct {
+	Info jobs.Info `json:"info"`
+	Job  jobs.Job  `json:"job"`
+}
+
+// MergeStrategy controls how Import reconciles an archived job with one that already exists server-side
+// under the same job ID
+type MergeStrategy int
+
+const (
+	// MergeSkipExisting leaves an already-present job untouched and does not import the archived copy
+	MergeSkipExisting MergeStrategy = iota
+	// MergeOverwrite replaces an already-present job's Info record with the archived copy
+	MergeOverwrite
+	// MergeRename imports the archived job under a newly generated job ID so it does not collide
+	MergeRename
+)
+
+// ImportOptions controls how Service.Import reconciles an archive with the running server's job state
+type ImportOptions struct {
+	// Merge determines what happens when an archived job ID already exists in the job repository
+	Merge MergeStrategy
+	// RemapAgents re-targets archived jobs from a lab agent ID to the corresponding prod agent ID (or
+	// vice versa), keyed by the agent ID recorded in the archive
+	RemapAgents map[uuid.UUID]uuid.UUID
+}
+
+// Export serializes every job's Info tracking record (one per agent/job, covering its full
+// Created/Sent/Returned/Complete/Canceled history), the Job payload for any job not yet delivered to
+// its agent, and any downloaded file blobs under data/agents/<id>/, into a single deterministic zip
+// archive with a manifest.json describing schema version, export timestamp, and per-agent job counts.
+// This lets an operator hand off a running engagement to a teammate or migrate between servers without
+// losing pending job tokens or gathered results.
+func (s *Service) Export(w io.Writer) error {
+	zw := zip.NewWriter(w)
+
+	m := manifest{
+		SchemaVersion: archiveSchemaVersion,
+		ExportedAt:    time.Now().UTC(),
+		AgentJobCount: make(map[string]int),
+	}
+
+	all := s.jobRepo.GetAll()
+	for id, info := range all {
+		m.AgentJobCount[info.AgentID().String()]++
+
+		f, err := zw.Create(fmt.Sprintf("history/%s.json", id))
+		if err != nil {
+			return fmt.Errorf("pkg/services/job.Export(): there was an error creating history/%s.json: %s", id, err)
+		}
+		if err = json.NewEncoder(f).Encode(info); err != nil {
+			return fmt.Errorf("pkg/services/job.Export(): there was an error encoding job %s: %s", id, err)
+		}
+	}
+
+	// GetJobs is the delivery-side accessor agents use to fetch real work, and marks every job it
+	// returns SENT as a side effect; Export must not call it, or simply archiving the repository would
+	// silently steal those jobs from the agents they are actually queued for. Filter the already-fetched
+	// read-only snapshot instead.
+	for id, info := range all {
+		if info.Status() != jobs.CREATED {
+			continue
+		}
+		pendingJob, errJob := s.jobRepo.GetJob(id)
+		if errJob != nil {
+			return fmt.Errorf("pkg/services/job.Export(): there was an error reading job %s: %s", id, errJob)
+		}
+		f, errCreate := zw.Create(fmt.Sprintf("pending/%s.json", id))
+		if errCreate != nil {
+			return fmt.Errorf("pkg/services/job.Export(): there was an error creating pending/%s.json: %s", id, errCreate)
+		}
+		record := pendingJobRecord{Info: info, Job: pendingJob}
+		if err = json.NewEncoder(f).Encode(record); err != nil {
+			return fmt.Errorf("pkg/services/job.Export(): there was an error encoding pending job %s: %s", id, err)
+		}
+	}
+
+	agentsDir := filepath.Join(core.CurrentDir, "data", "agents")
+	if entries, err := ioutil.ReadDir(agentsDir); err == nil {
+		for _, agentDir := range entries {
+			if !agentDir.IsDir() {
+				continue
+			}
+			errWalk := filepath.Walk(filepath.Join(agentsDir, agentDir.Name()), func(path string, info os.FileInfo, err error) error {
+				if err != nil || info.IsDir() {
+					return err
+				}
+				rel, errRel := filepath.Rel(agentsDir, path)
+				if errRel != nil {
+					return errRel
+				}
+				dst, errCreate := zw.Create(agentDataPrefix + filepath.ToSlash(rel))
+				if errCreate != nil {
+					return errCreate
+				}
+				src, errOpen := os.Open(path)
+				if errOpen != nil {
+					return errOpen
+				}
+				defer src.Close()
+				_, errCopy := io.Copy(dst, src)
+				return errCopy
+			})
+			if errWalk != nil {
+				return fmt.Errorf("pkg/services/job.Export(): there was an error archiving agent data: %s", errWalk)
+			}
+		}
+	}
+
+	mf, err := zw.Create("manifest.json")
+	if err != nil {
+		return fmt.Errorf("pkg/services/job.Export(): there was an error creating manifest.json: %s", err)
+	}
+	if err = json.NewEncoder(mf).Encode(m); err != nil {
+		return fmt.Errorf("pkg/services/job.Export(): there was an error encoding manifest.json: %s", err)
+	}
+
+	return zw.Close()
+}
+
+// Import reads a Service.Export archive from r and replays its pending job records into the running
+// job repository (and its agent data files onto disk), following opts.Merge for ID collisions and
+// remapping agent IDs through opts.RemapAgents
+func (s *Service) Import(r io.ReaderAt, size int64, opts ImportOptions) error {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("pkg/services/job.Import(): there was an error opening the archive: %s", err)
+	}
+
+	var m manifest
+	for _, f := range zr.File {
+		if f.Name == "manifest.json" {
+			rc, errOpen := f.Open()
+			if errOpen != nil {
+				return fmt.Errorf("pkg/services/job.Import(): there was an error opening manifest.json: %s", errOpen)
+			}
+			errDecode := json.NewDecoder(rc).Decode(&m)
+			rc.Close()
+			if errDecode != nil {
+				return fmt.Errorf("pkg/services/job.Import(): there was an error decoding manifest.json: %s", errDecode)
+			}
+			if m.SchemaVersion != archiveSchemaVersion {
+				return fmt.Errorf("pkg/services/job.Import(): unsupported archive schema version %d", m.SchemaVersion)
+			}
+			break
+		}
+	}
+
+	for _, f := range zr.File {
+		switch {
+		case strings.HasPrefix(f.Name, "pending/"):
+			if err = s.importPendingJob(f, opts); err != nil {
+				return err
+			}
+		case strings.HasPrefix(f.Name, agentDataPrefix):
+			if err = s.importAgentFile(f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// importPendingJob decodes a single pending/<id>.json archive entry and re-queues it in the repository,
+// applying the agent ID remap and merge strategy from opts
+func (s *Service) importPendingJob(f *zip.File, opts ImportOptions) error {
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("pkg/services/job.Import(): there was an error opening %s: %s", f.Name, err)
+	}
+	defer rc.Close()
+
+	var record pendingJobRecord
+	if err = json.NewDecoder(rc).Decode(&record); err != nil {
+		return fmt.Errorf("pkg/services/job.Import(): there was an error decoding %s: %s", f.Name, err)
+	}
+
+	if remapped, ok := opts.RemapAgents[record.Job.AgentID]; ok {
+		record.Job.AgentID = remapped
+	}
+
+	if _, errExisting := s.jobRepo.GetInfo(record.Job.ID); errExisting == nil {
+		switch opts.Merge {
+		case MergeSkipExisting:
+			return nil
+		case MergeRename:
+			newID := uuid.NewV4().String()
+			record.Job.ID = newID
+			record.Info.SetID(newID)
+		case MergeOverwrite:
+			// fall through and re-Add, which overwrites the existing record
+		}
+	}
+
+	s.jobRepo.Add(record.Job, record.Info)
+	return nil
+}
+
+// importAgentFile restores a single archived agent data file (e.g. a downloaded loot file) to its
+// original location under data/agents/. The entry name comes straight from the archive, which is
+// exchanged between operators/servers as untrusted input, so it must be confirmed to stay under the
+// agents directory before anything is created on disk.
+func (s *Service) importAgentFile(f *zip.File) error {
+	agentsDir := filepath.Join(core.CurrentDir, "data", "agents")
+	rel := strings.TrimPrefix(f.Name, agentDataPrefix)
+	dst := filepath.Join(agentsDir, filepath.FromSlash(rel))
+	if dst != agentsDir && !strings.HasPrefix(dst, agentsDir+string(os.PathSeparator)) {
+		return fmt.Errorf("pkg/services/job.Import(): archive entry %q escapes the agents directory", f.Name)
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return fmt.Errorf("pkg/services/job.Import(): there was an error creating %s: %s", filepath.Dir(dst), err)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return fmt.Errorf("pkg/services/job.Import(): there was an error opening %s: %s", f.Name, err)
+	}
+	defer rc.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return fmt.Errorf("pkg/services/job.Import(): there was an error creating %s: %s", dst, err)
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, rc)
+	return err
+}
@@ -20,15 +20,18 @@ package job
 
 import (
 	// Standard
+	"bytes"
+	"compress/zlib"
 	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	// 3rd Party
@@ -40,8 +43,10 @@ import (
 	"github.com/Ne0nd0g/merlin/pkg/core"
 	"github.com/Ne0nd0g/merlin/pkg/jobs"
 	"github.com/Ne0nd0g/merlin/pkg/jobs/memory"
+	queuememory "github.com/Ne0nd0g/merlin/pkg/jobs/queue/memory"
 	"github.com/Ne0nd0g/merlin/pkg/messages"
 	"github.com/Ne0nd0g/merlin/pkg/modules/socks"
+	"github.com/Ne0nd0g/merlin/pkg/peer"
 	"github.com/Ne0nd0g/merlin/pkg/services/agent"
 )
 
@@ -49,29 +54,308 @@ import (
 type Service struct {
 	jobRepo      jobs.Repository
 	agentService *agent.Service
+	// workers holds the per-agent job worker channel used by Handler to keep one agent's jobs in order
+	// while different agents' jobs are processed concurrently; see workerpool.go
+	workers   map[uuid.UUID]chan workItem
+	workersMu sync.Mutex
+	// peers is the parent->child pivot topology used to route jobs to agents that are not directly
+	// connected to one of the server's own listeners; see peer.go
+	peers *peer.Graph
+	// queue durably tracks every dispatched job until it is Acked, so a restart or a channel backed up
+	// behind a slow agent doesn't silently lose it; see queue.go
+	queue jobs.Queue
+	// testProcessJob, if set, stands in for processJob in agentWorker. It exists only so
+	// workerpool_test.go can exercise the dispatch/agentWorker concurrency contract with a controllable
+	// job handler instead of a live agentService.
+	testProcessJob func(jobs.Job) error
 }
 
 // memoryService is an in-memory instantiation of the Agent service so that it can be used by others
 var memoryService *Service
 
-// NewJobService is a factory to create a Job service to be used by other packages or services
-func NewJobService() *Service {
+// Option is used to configure a Service at construction time via NewJobService, e.g. to swap out
+// the backing jobs.Repository implementation
+type Option func(*Service)
+
+// NewJobService is a factory to create a Job service to be used by other packages or services.
+// By default jobs are tracked in the in-memory repository; pass WithRepository to persist job state
+// so it survives a server restart.
+func NewJobService(options ...Option) *Service {
 	if memoryService == nil {
 		memoryService = &Service{
 			jobRepo:      WithJobMemoryRepository(),
 			agentService: agent.NewAgentService(),
+			peers:        peer.DefaultGraph,
+			queue:        WithMemoryQueue(),
+		}
+		for _, option := range options {
+			option(memoryService)
 		}
+		// Replay any job a prior instance dispatched but never Acked before it went away
+		memoryService.replayQueue()
 	}
 	// Start the SOCKS infinite loop
 	go memoryService.socksJobs()
+	// Start the SOCKS UDP ASSOCIATE infinite loop
+	go memoryService.socksUDPJobs()
+	// Start the goroutine that expires jobs left SENT past their Timeout
+	go memoryService.expireJobs()
+	// Start the goroutine that sweeps out old COMPLETE/CANCELED/EXPIRED jobs
+	go memoryService.sweepCompletedJobs()
 	return memoryService
 }
 
+// WithJobMemoryRepository returns the default, in-memory job repository. Job state created with this
+// repository does not survive a server restart.
 func WithJobMemoryRepository() jobs.Repository {
 	return memory.NewRepository()
 }
 
+// WithRepository overrides the default in-memory job repository with the provided implementation,
+// e.g. the SQL-backed repository in pkg/jobs/sql for engagements that need job state to survive restarts
+func WithRepository(repo jobs.Repository) Option {
+	return func(s *Service) {
+		s.jobRepo = repo
+	}
+}
+
+// WithMemoryQueue returns the default, in-memory job queue. Entries tracked with this queue do not
+// survive a server restart.
+func WithMemoryQueue() jobs.Queue {
+	return queuememory.NewQueue()
+}
+
+// WithQueue overrides the default in-memory job queue with the provided implementation, e.g. the
+// SQL-backed queue in pkg/jobs/queue/sql so in-flight jobs can be replayed after a restart
+func WithQueue(q jobs.Queue) Option {
+	return func(s *Service) {
+		s.queue = q
+	}
+}
+
+// replayQueue re-dispatches every job a prior server instance enqueued for a currently known agent but
+// never received an Ack for, e.g. because the process was restarted while the job was still in flight.
+// It is only useful paired with a durable jobRepo/queue pair (see WithRepository, WithQueue); with the
+// in-memory defaults the agentService won't know about any agents yet and this is a no-op.
+func (s *Service) replayQueue() {
+	for _, a := range s.agentService.Agents() {
+		pending, err := s.queue.Peek(a.ID())
+		if err != nil {
+			fmt.Printf("pkg/services/job.replayQueue(): there was an error peeking agent %s's queue: %s\n", a.ID(), err)
+			continue
+		}
+		for _, job := range pending {
+			// Already tracked in the job repository; nothing to replay
+			if _, err = s.jobRepo.GetInfo(job.ID); err == nil {
+				continue
+			}
+			jobInfo := jobs.NewInfo(job.AgentID, jobs.String(job.Type), "")
+			jobInfo.SetPriority(job.Priority)
+			jobInfo.SetSchedule(job.Schedule)
+			s.jobRepo.Add(job, jobInfo)
+			a.Log(fmt.Sprintf("Replayed un-acked job %s from the durable queue after a restart", job.ID))
+		}
+	}
+}
+
+// Job priority constants used to order the per-agent job queue; higher values are dispatched first.
+// defaultPriority holds the default assigned to each jobType when the caller does not specify one,
+// so that control-plane jobs like exit/sleep/killdate jump ahead of bulky module or file transfer jobs.
+const (
+	PriorityLow    = 10
+	PriorityNormal = 50
+	PriorityHigh   = 100
+)
+
+// defaultPriority maps a jobType to the priority it is queued at when Add (rather than AddScheduled) is used
+var defaultPriority = map[string]int{
+	"exit":              PriorityHigh,
+	"sleep":             PriorityHigh,
+	"killdate":          PriorityHigh,
+	"killprocess":       PriorityHigh,
+	"maxretry":          PriorityHigh,
+	"skew":              PriorityHigh,
+	"ja3":               PriorityHigh,
+	"padding":           PriorityHigh,
+	"load-assembly":     PriorityLow,
+	"upload":            PriorityLow,
+	"download":          PriorityLow,
+	"memfd":             PriorityLow,
+	"execute-pe":        PriorityLow,
+	"execute-shellcode": PriorityLow,
+}
+
+// compressionThreshold is the raw payload size, in bytes, above which Add zlib-compresses a file
+// transfer or module blob before base64-encoding it for the wire
+const compressionThreshold = 10 * 1024 // 10 KiB
+
+// maxEncodedPayloadSize is the maximum size, in bytes, a payload may reach after compression (or its
+// raw size, if under compressionThreshold) before Add rejects it rather than queuing something the
+// transport will choke on
+const maxEncodedPayloadSize = 20 * 1024 * 1024 // 20 MiB
+
+// uploadChunkSize is the raw, pre-compression size addUpload splits a server-side file into before
+// queuing each piece as its own FILETRANSFER job. This gives the upload-to-agent direction the same
+// chunked, resumable, per-chunk-verified protocol transfer.go already provides for the agent-to-server
+// (download) direction, instead of one oversized, unresumable, unverifiable blob.
+const uploadChunkSize = 1024 * 1024 // 1 MiB
+
+// encodeBlob zlib-compresses raw when it exceeds compressionThreshold and base64-encodes the result,
+// returning whether compression was applied so the agent knows to reverse it. It is used for
+// load-assembly, memfd, and upload payloads, which are large enough to benefit from compression
+// over the wire.
+func encodeBlob(raw []byte) (encoded string, compressed bool, err error) {
+	payload := raw
+	if len(raw) > compressionThreshold {
+		var buf bytes.Buffer
+		w := zlib.NewWriter(&buf)
+		if _, err = w.Write(raw); err != nil {
+			return "", false, fmt.Errorf("there was an error compressing the payload: %s", err)
+		}
+		if err = w.Close(); err != nil {
+			return "", false, fmt.Errorf("there was an error finalizing payload compression: %s", err)
+		}
+		payload = buf.Bytes()
+		compressed = true
+	}
+	if len(payload) > maxEncodedPayloadSize {
+		return "", false, fmt.Errorf("payload size of %d bytes exceeds the maximum allowed size of %d bytes", len(payload), maxEncodedPayloadSize)
+	}
+	return base64.StdEncoding.EncodeToString(payload), compressed, nil
+}
+
+// Add builds a job for the given agent and jobType and immediately queues it FIFO (ordered by each
+// jobType's default priority) for delivery on the agent's next check-in
 func (s *Service) Add(agentID uuid.UUID, jobType string, jobArgs []string) (string, error) {
+	priority, ok := defaultPriority[jobType]
+	if !ok {
+		priority = PriorityNormal
+	}
+
+	if jobType == "upload" {
+		return s.addUpload(agentID, jobArgs, time.Time{}, priority)
+	}
+
+	job, err := s.buildJobPayload(jobType, jobArgs)
+	if err != nil {
+		return "", err
+	}
+	job.Priority = priority
+	job.Timeout = timeoutFor(jobType)
+
+	return s.AddJobChannel(agentID, job, jobArgs)
+}
+
+// AddScheduled builds a job exactly like Add, but does not make it eligible for delivery until the
+// agent's check-in time reaches schedule, and orders it in the agent's queue by the given priority
+// (see the Priority* constants) instead of the jobType's default. This lets an operator, for example,
+// queue a sleep to fire at 2AM local time or bump a killprocess above a pending upload.
+func (s *Service) AddScheduled(agentID uuid.UUID, jobType string, jobArgs []string, schedule time.Time, priority int) (string, error) {
+	if jobType == "upload" {
+		return s.addUpload(agentID, jobArgs, schedule, priority)
+	}
+
+	job, err := s.buildJobPayload(jobType, jobArgs)
+	if err != nil {
+		return "", err
+	}
+	job.Schedule = schedule
+	job.Priority = priority
+	job.Timeout = timeoutFor(jobType)
+
+	return s.AddJobChannel(agentID, job, jobArgs)
+}
+
+// addUpload reads jobArgs[0] off disk and queues it to agentID as a chunked FILETRANSFER: one job per
+// uploadChunkSize-sized, zlib-compressed, SHA-256-verified data chunk, followed by a manifest job
+// carrying the whole-file SHA-256, all sharing a single TransferID. Every job is queued through the
+// normal AddJobChannel path, so schedule/priority/timeout and the durable queue behave exactly like any
+// other job.
+func (s *Service) addUpload(agentID uuid.UUID, jobArgs []string, schedule time.Time, priority int) (results string, err error) {
+	// jobArgs[0] - server-side source file location
+	// jobArgs[1] - agent-side file write location
+	// jobArgs[2] - calculated SHA256 hash
+	// jobArgs[3] - file size
+	if len(jobArgs) < 2 {
+		return "", fmt.Errorf("expected 2 arguments for upload command, received %d", len(jobArgs))
+	}
+
+	raw, errRead := ioutil.ReadFile(jobArgs[0])
+	if errRead != nil {
+		return "", fmt.Errorf("there was an error reading %s: %v", jobArgs[0], errRead)
+	}
+
+	fileSum := sha256.Sum256(raw)
+	fileHash := hex.EncodeToString(fileSum[:])
+	if len(jobArgs) > 2 {
+		jobArgs[2] = fileHash
+	} else {
+		jobArgs = append(jobArgs, fileHash)
+	}
+	if len(jobArgs) > 3 {
+		jobArgs[3] = fmt.Sprintf("%d", len(raw))
+	} else {
+		jobArgs = append(jobArgs, fmt.Sprintf("%d", len(raw)))
+	}
+
+	totalChunks := (len(raw) + uploadChunkSize - 1) / uploadChunkSize
+	if totalChunks == 0 {
+		totalChunks = 1 // an empty file is still one, zero-length chunk
+	}
+	transferID := uuid.NewV4().String()
+	timeout := timeoutFor("upload")
+
+	for i := 0; i < totalChunks; i++ {
+		start := i * uploadChunkSize
+		end := start + uploadChunkSize
+		if end > len(raw) {
+			end = len(raw)
+		}
+		chunkSum := sha256.Sum256(raw[start:end])
+		blob, compressed, errEncode := encodeBlob(raw[start:end])
+		if errEncode != nil {
+			return results, errEncode
+		}
+		job := &jobs.Job{
+			Type: jobs.FILETRANSFER,
+			Payload: jobs.FileTransfer{
+				FileLocation: jobArgs[1],
+				FileBlob:     blob,
+				IsDownload:   true,
+				Compressed:   compressed,
+				TransferID:   transferID,
+				ChunkIndex:   i,
+				TotalChunks:  totalChunks,
+				ChunkSHA256:  hex.EncodeToString(chunkSum[:]),
+			},
+			Schedule: schedule,
+			Priority: priority,
+			Timeout:  timeout,
+		}
+		if results, err = s.AddJobChannel(agentID, job, jobArgs); err != nil {
+			return results, err
+		}
+	}
+
+	manifest := &jobs.Job{
+		Type: jobs.FILETRANSFER,
+		Payload: jobs.FileTransfer{
+			FileLocation: jobArgs[1],
+			IsDownload:   true,
+			TransferID:   transferID,
+			TotalChunks:  totalChunks,
+			SHA256:       fileHash,
+		},
+		Schedule: schedule,
+		Priority: priority,
+		Timeout:  timeout,
+	}
+	return s.AddJobChannel(agentID, manifest, jobArgs)
+}
+
+// buildJobPayload translates a jobType and its CLI-style arguments into the jobs.Job payload that the
+// agent understands, without yet queuing it for any agent
+func (s *Service) buildJobPayload(jobType string, jobArgs []string) (*jobs.Job, error) {
 	var job jobs.Job
 
 	switch jobType {
@@ -80,6 +364,15 @@ func (s *Service) Add(agentID uuid.UUID, jobType string, jobArgs []string) (stri
 		job.Payload = jobs.Command{
 			Command: "agentInfo",
 		}
+	case "auth":
+		if len(jobArgs) < 1 {
+			return nil, fmt.Errorf("exected at least 1 argument for the auth command, received: %+v", jobArgs)
+		}
+		job.Type = jobs.AUTH
+		job.Payload = jobs.Auth{
+			Scheme: jobArgs[0],
+			Args:   jobArgs[1:],
+		}
 	case "download":
 		job.Type = jobs.FILETRANSFER
 		p := jobs.FileTransfer{
@@ -136,7 +429,7 @@ func (s *Service) Add(agentID uuid.UUID, jobType string, jobArgs []string) (stri
 		job.Payload = p
 	case "invoke-assembly":
 		if len(jobArgs) < 1 {
-			return "", fmt.Errorf("exected 1 argument for the invoke-assembly command, received: %+v", jobArgs)
+			return nil, fmt.Errorf("exected 1 argument for the invoke-assembly command, received: %+v", jobArgs)
 		}
 		job.Type = jobs.MODULE
 		job.Payload = jobs.Command{
@@ -194,12 +487,12 @@ func (s *Service) Add(agentID uuid.UUID, jobType string, jobArgs []string) (stri
 		// jobArgs[1] - Assembly name
 		// jobArgs[2] - calculated SHA256 hash
 		if len(jobArgs) < 1 {
-			return "", fmt.Errorf("exected 1 argument for the load-assembly command, received: %+v", jobArgs)
+			return nil, fmt.Errorf("exected 1 argument for the load-assembly command, received: %+v", jobArgs)
 		}
 		job.Type = jobs.MODULE
 		assembly, err := ioutil.ReadFile(jobArgs[0])
 		if err != nil {
-			return "", fmt.Errorf("there was an error reading the assembly at %s:\n%s", jobArgs[0], err)
+			return nil, fmt.Errorf("there was an error reading the assembly at %s:\n%s", jobArgs[0], err)
 		}
 
 		name := filepath.Base(jobArgs[0])
@@ -210,17 +503,22 @@ func (s *Service) Add(agentID uuid.UUID, jobType string, jobArgs []string) (stri
 		fileHash := sha256.New()
 		_, err = io.WriteString(fileHash, string(assembly))
 		if err != nil {
-			return "", fmt.Errorf("there was an error generating a file hash: %s", err)
+			return nil, fmt.Errorf("there was an error generating a file hash: %s", err)
 		}
 		jobArgs = append(jobArgs, fmt.Sprintf("%s", fileHash.Sum(nil)))
 
+		encoded, compressed, err := encodeBlob(assembly)
+		if err != nil {
+			return nil, err
+		}
 		job.Payload = jobs.Command{
-			Command: "clr",
-			Args:    []string{jobType, base64.StdEncoding.EncodeToString([]byte(assembly)), name},
+			Command:    "clr",
+			Args:       []string{jobType, encoded, name},
+			Compressed: compressed,
 		}
 	case "load-clr":
 		if len(jobArgs) < 1 {
-			return "", fmt.Errorf("exected 1 argument for the load-clr command, received: %+v", jobArgs)
+			return nil, fmt.Errorf("exected 1 argument for the load-clr command, received: %+v", jobArgs)
 		}
 		job.Type = jobs.MODULE
 		job.Payload = jobs.Command{
@@ -257,22 +555,26 @@ func (s *Service) Add(agentID uuid.UUID, jobType string, jobArgs []string) (stri
 		}
 	case "memfd":
 		if len(jobArgs) < 1 {
-			return "", fmt.Errorf("expected 1 argument for the memfd command, received %d", len(jobArgs))
+			return nil, fmt.Errorf("expected 1 argument for the memfd command, received %d", len(jobArgs))
 		}
 		executable, err := ioutil.ReadFile(jobArgs[0])
 		if err != nil {
-			return "", fmt.Errorf("there was an error reading %s: %v", jobArgs[0], err)
+			return nil, fmt.Errorf("there was an error reading %s: %v", jobArgs[0], err)
 		}
 		fileHash := sha256.New()
 		_, err = io.WriteString(fileHash, string(executable))
 		if err != nil {
-			return "", fmt.Errorf("there was an error generating file hash: %s", err)
+			return nil, fmt.Errorf("there was an error generating file hash: %s", err)
+		}
+		b, compressed, err := encodeBlob(executable)
+		if err != nil {
+			return nil, err
 		}
-		b := base64.StdEncoding.EncodeToString(executable)
 		job.Type = jobs.MODULE
 		job.Payload = jobs.Command{
-			Command: jobType,
-			Args:    append([]string{b}, jobArgs[1:]...),
+			Command:    jobType,
+			Args:       append([]string{b}, jobArgs[1:]...),
+			Compressed: compressed,
 		}
 	case "Minidump":
 		job.Type = jobs.MODULE
@@ -319,7 +621,7 @@ func (s *Service) Add(agentID uuid.UUID, jobType string, jobArgs []string) (stri
 	case "pwd":
 		job.Type = jobs.NATIVE
 		p := jobs.Command{
-			Command: jobArgs[0], // TODO This should be in the jobType position
+			Command: jobType,
 		}
 		job.Payload = p
 	case "rm":
@@ -367,7 +669,7 @@ func (s *Service) Add(agentID uuid.UUID, jobType string, jobArgs []string) (stri
 		} else if payload.Method == "remote" || payload.Method == "rtlcreateuserthread" || payload.Method == "userapc" {
 			i, err := strconv.Atoi(jobArgs[1])
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 			payload.PID = uint32(i)
 			payload.Bytes = jobArgs[2]
@@ -419,42 +721,10 @@ func (s *Service) Add(agentID uuid.UUID, jobType string, jobArgs []string) (stri
 		}
 		job.Payload = p
 	case "upload":
-		// jobArgs[0] - server-side source file location
-		// jobArgs[1] - agent-side file write location
-		// jobArgs[2] - calculated SHA256 hash
-		// jobArgs[3] - file size
-		job.Type = jobs.FILETRANSFER
-		if len(jobArgs) < 2 {
-			return "", fmt.Errorf("expected 2 arguments for upload command, received %d", len(jobArgs))
-		}
-		uploadFile, uploadFileErr := ioutil.ReadFile(jobArgs[0])
-		if uploadFileErr != nil {
-			// TODO send "ServerOK"
-			return "", fmt.Errorf("there was an error reading %s: %v", jobs.String(job.Type), uploadFileErr)
-		}
-		fileHash := sha256.New()
-		_, err := io.WriteString(fileHash, string(uploadFile))
-		if err != nil {
-			return "", fmt.Errorf("there was an error generating file hash: %s", err)
-		}
-		if len(jobArgs) > 2 {
-			jobArgs[2] = fmt.Sprintf("%s", fileHash.Sum(nil))
-		} else {
-			jobArgs = append(jobArgs, fmt.Sprintf("%s", fileHash.Sum(nil)))
-		}
-
-		if len(jobArgs) > 3 {
-			jobArgs[3] = fmt.Sprintf("%d", len(uploadFile))
-		} else {
-			jobArgs = append(jobArgs, fmt.Sprintf("%d", len(uploadFile)))
-		}
-
-		p := jobs.FileTransfer{
-			FileLocation: jobArgs[1],
-			FileBlob:     base64.StdEncoding.EncodeToString([]byte(uploadFile)),
-			IsDownload:   true,
-		}
-		job.Payload = p
+		// Chunked, resumable, and dispatched across multiple Job records by addUpload instead of a
+		// single oversized blob here; Add/AddScheduled special-case "upload" before ever reaching this
+		// switch, so this case only exists to document why it's missing
+		return nil, fmt.Errorf("upload is built by addUpload, not buildJobPayload")
 	case "uptime":
 		job.Type = jobs.MODULE
 		p := jobs.Command{
@@ -462,10 +732,10 @@ func (s *Service) Add(agentID uuid.UUID, jobType string, jobArgs []string) (stri
 		}
 		job.Payload = p
 	default:
-		return "", fmt.Errorf("invalid job type: %d", job.Type)
+		return nil, fmt.Errorf("invalid job type: %d", job.Type)
 	}
 
-	return s.AddJobChannel(agentID, &job, jobArgs)
+	return &job, nil
 }
 
 // AddJobChannel adds an already built Agent Job to the agent's job channel to be sent to the agent when it checks in.
@@ -542,17 +812,23 @@ func (s *Service) buildJob(agentID uuid.UUID, job *jobs.Job, jobArgs []string) e
 	case jobs.FILETRANSFER:
 		cmd := job.Payload.(jobs.FileTransfer)
 		if cmd.IsDownload {
-			// Upload to agent (the server is uploading a file that the agent is downloading the file from the server)
-			if len(jobArgs) > 2 {
-				msg := fmt.Sprintf(
-					"Uploading file from server at %s of size %s bytes and SHA-256: %x to agent at %s",
-					jobArgs[0],
-					jobArgs[3],
-					jobArgs[2],
-					jobArgs[1],
-				)
-				agent.Log(msg)
-				command = fmt.Sprintf("upload %s %s", jobArgs[0], jobArgs[1])
+			// Upload to agent (the server is uploading a file that the agent is downloading the file
+			// from the server), dispatched by addUpload as a chunk of a larger transfer; the manifest
+			// chunk (SHA256 set, no FileBlob) is the only one worth logging in full
+			if cmd.SHA256 != "" {
+				if len(jobArgs) > 2 {
+					agent.Log(fmt.Sprintf(
+						"Uploading file from server at %s of size %s bytes and SHA-256: %s to agent at %s across %d chunk(s)",
+						jobArgs[0],
+						jobArgs[3],
+						jobArgs[2],
+						jobArgs[1],
+						cmd.TotalChunks,
+					))
+				}
+				command = fmt.Sprintf("upload %s %s manifest", jobArgs[0], jobArgs[1])
+			} else {
+				command = fmt.Sprintf("upload %s %s chunk %d/%d", jobArgs[0], jobArgs[1], cmd.ChunkIndex+1, cmd.TotalChunks)
 			}
 		} else {
 			// Download from agent (the server is download a file to the agent is uploading a file to the server)
@@ -565,8 +841,18 @@ func (s *Service) buildJob(agentID uuid.UUID, job *jobs.Job, jobArgs []string) e
 		cmd := job.Payload.(jobs.Shellcode)
 		command = fmt.Sprintf("shellcode %s %d length %d", cmd.Method, cmd.PID, len(cmd.Bytes))
 	case jobs.SOCKS:
-		conn := job.Payload.(jobs.Socks)
-		command = fmt.Sprintf("SOCKS connection %s packet %d", conn.ID, conn.Index)
+		switch conn := job.Payload.(type) {
+		case jobs.SocksUDP:
+			command = fmt.Sprintf("SOCKS UDP association %s datagram %d", conn.ID, conn.Index)
+		default:
+			c := job.Payload.(jobs.Socks)
+			command = fmt.Sprintf("SOCKS connection %s packet %d", c.ID, c.Index)
+		}
+	case jobs.AUTH:
+		// Never log cmd.Args; for basic/bearer it's a password or token outright, and for ntlm the
+		// user/domain is still not worth persisting into the job history in cleartext
+		cmd := job.Payload.(jobs.Auth)
+		command = fmt.Sprintf("auth %s", cmd.Scheme)
 	default:
 		fmt.Printf("DEFAULT\n")
 		command = fmt.Sprintf("%s %+v", jobs.String(job.Type), job.Payload)
@@ -574,6 +860,9 @@ func (s *Service) buildJob(agentID uuid.UUID, job *jobs.Job, jobArgs []string) e
 
 	// Create Job info structure
 	jobInfo := jobs.NewInfo(agentID, jobs.String(job.Type), command)
+	jobInfo.SetSchedule(job.Schedule)
+	jobInfo.SetPriority(job.Priority)
+	jobInfo.SetTimeout(job.Timeout)
 
 	// SOCKS jobs create their own token that is used through the lifetime of the connection
 	if job.Token == uuid.Nil {
@@ -585,6 +874,17 @@ func (s *Service) buildJob(agentID uuid.UUID, job *jobs.Job, jobArgs []string) e
 		job.ID = jobInfo.ID()
 	}
 
+	// Durably track the job, addressed to its true destination agentID, until it is Acked; this is what
+	// lets replayQueue re-dispatch it if the server restarts before that happens
+	if err := s.queue.Enqueue(agentID, *job); err != nil {
+		fmt.Printf("pkg/services/job.buildJob(): there was an error enqueueing job %s: %s\n", job.ID, err)
+	}
+
+	// If agentID is not directly connected to one of the server's own listeners, wrap the job in LINK
+	// frames addressed to the nearest ancestor agent that is, so the pivot chain can relay it the rest
+	// of the way. jobInfo keeps tracking the true destination agentID regardless of how it is delivered.
+	*job = s.routeJob(agentID, *job)
+
 	// Add job to the server side job list
 	s.jobRepo.Add(*job, jobInfo)
 
@@ -632,72 +932,6 @@ func (s *Service) ClearAll() error {
 	return s.jobRepo.ClearAll()
 }
 
-// fileTransfer handles file upload/download operations
-func (s *Service) fileTransfer(agentID uuid.UUID, p jobs.FileTransfer) error {
-	// Check to make sure it is a known agent
-	if !s.agentService.Exist(agentID) {
-		return fmt.Errorf("%s is not a valid agent", agentID)
-	}
-
-	if p.IsDownload {
-		agentsDir := filepath.Join(core.CurrentDir, "data", "agents")
-		_, f := filepath.Split(p.FileLocation) // We don't need the directory part for anything
-		if _, errD := os.Stat(agentsDir); os.IsNotExist(errD) {
-			errorMessage := fmt.Errorf("there was an error locating the agent's directory:\r\n%s", errD.Error())
-			err := s.agentService.Log(agentID, errorMessage.Error())
-			if err != nil {
-				return fmt.Errorf("there were to errors:\n\t%s\n\t%s", errorMessage, err)
-			}
-			return errorMessage
-		}
-		userMessage := messageAPI.UserMessage{
-			Level:   messageAPI.Success,
-			Time:    time.Now().UTC(),
-			Message: fmt.Sprintf("Results for %s at %s", agentID, time.Now().UTC().Format(time.RFC3339)),
-		}
-		messageAPI.SendBroadcastMessage(userMessage)
-		downloadBlob, downloadBlobErr := base64.StdEncoding.DecodeString(p.FileBlob)
-
-		if downloadBlobErr != nil {
-			errorMessage := fmt.Errorf("there was an error decoding the fileBlob:\r\n%s", downloadBlobErr.Error())
-			err := s.agentService.Log(agentID, errorMessage.Error())
-			if err != nil {
-				return fmt.Errorf("there were to errors:\n\t%s\n\t%s", errorMessage, err)
-			}
-			return errorMessage
-		}
-		downloadFile := filepath.Join(agentsDir, agentID.String(), f)
-		writingErr := ioutil.WriteFile(downloadFile, downloadBlob, 0600)
-		if writingErr != nil {
-			errorMessage := fmt.Errorf("there was an error writing to -> %s:\r\n%s", p.FileLocation, writingErr.Error())
-			err := s.agentService.Log(agentID, errorMessage.Error())
-			if err != nil {
-				return fmt.Errorf("there were to errors:\n\t%s\n\t%s", errorMessage, err)
-			}
-			return errorMessage
-		}
-		successMessage := fmt.Sprintf("Successfully downloaded file %s with a size of %d bytes from agent %s to %s",
-			p.FileLocation,
-			len(downloadBlob),
-			agentID.String(),
-			downloadFile)
-
-		userMessage = messageAPI.UserMessage{
-			Level:   messageAPI.Success,
-			Time:    time.Now().UTC(),
-			Message: successMessage,
-		}
-		messageAPI.SendBroadcastMessage(userMessage)
-
-		err := s.agentService.Log(agentID, successMessage)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 // Get returns a list of jobs that need to be sent to the agent
 func (s *Service) Get(agentID uuid.UUID) ([]jobs.Job, error) {
 	return s.jobRepo.GetJobs(agentID)
@@ -734,13 +968,19 @@ func (s *Service) GetTableActive(agentID uuid.UUID) ([][]string, error) {
 				if job.Sent() != zeroTime {
 					sent = job.Sent().Format(time.RFC3339)
 				}
-				// <JobID>, <Command>, <JobStatus>, <Created>, <Sent>
+				var schedule string
+				if job.Schedule() != zeroTime {
+					schedule = job.Schedule().Format(time.RFC3339)
+				}
+				// <JobID>, <Command>, <JobStatus>, <Created>, <Sent>, <Schedule>, <Priority>
 				agentJobs = append(agentJobs, []string{
 					id,
 					job.Command(),
 					status,
 					job.Created().Format(time.RFC3339),
 					sent,
+					schedule,
+					fmt.Sprintf("%d", job.Priority()),
 				})
 			}
 		}
@@ -784,102 +1024,193 @@ func (s *Service) GetTableAll() [][]string {
 	return agentJobs
 }
 
-// Handler evaluates a message sent in by the agent and the subsequently executes any corresponding tasks
+// Handler evaluates messages sent in by agents and executes any corresponding tasks. Jobs are
+// dispatched to a per-agent worker (see workerpool.go) so that jobs for the same agent are processed
+// in order while unrelated agents, including ones with slow FILETRANSFER work in flight, proceed in
+// parallel without blocking each other.
 func (s *Service) Handler(agentJobs []jobs.Job) error {
-	// Iterate over each job
+	var wg sync.WaitGroup
+	errs := make(chan error, len(agentJobs))
+
 	for _, job := range agentJobs {
-		// Make sure the Agent is known to the server
-		if s.agentService.Exist(job.AgentID) {
-			agent, err := s.agentService.Agent(job.AgentID)
-			if err != nil {
-				return err
-			}
+		wg.Add(1)
+		s.dispatch(job, &wg, errs)
+	}
+	wg.Wait()
+	close(errs)
 
-			// Get the job info structure
-			jobInfo, err := s.jobRepo.GetInfo(job.ID)
-			if err != nil {
-				return fmt.Errorf("pkg/services/job.Handler(): %s", err)
-			}
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			// Verify that the job contains the correct token and that it was not already completed
-			err = s.checkJob(job)
-			if err != nil {
+// processJob evaluates a single message sent in by an agent and executes its corresponding task. It
+// follows the "terminal-message-last" discipline: the job's Info record is only ever updated to a
+// terminal status (COMPLETE/CANCELED) as the very last write, and only after the task's handler
+// (fileTransfer, socks close, etc.) has fully returned without error.
+func (s *Service) processJob(job jobs.Job) error {
+	// A LINK frame is the relaying agent handing back a job that actually belongs to one of its
+	// descendants in the pivot chain; unwrap one hop and recurse until the innermost job, addressed to
+	// its true originating agent, is reached. The envelope itself was never a tracked queue entry, only
+	// the unwrapped job underneath it is, so Ack/Nack happens in processAgentJob, not here.
+	if job.Type == jobs.LINK {
+		inner, err := s.unwrapLink(job)
+		if err != nil {
+			return err
+		}
+		return s.processJob(inner)
+	}
+	return s.processAgentJob(job)
+}
 
-				// Agent will send back error messages that are not the result of a job
-				if job.Type != jobs.RESULT {
-					return err
-				}
-				if core.Debug {
-					fmt.Printf("Received %s message without job token: %s\n", messages.String(job.Type), err)
-				}
+// processAgentJob evaluates a single job addressed directly to its destination agent (i.e. with any
+// LINK envelope already unwrapped) and reports the outcome back to the job queue: Ack once the terminal
+// jobInfo update below succeeds, or Nack - which applies an exponential backoff before the job becomes
+// eligible for re-dispatch - if anything along the way failed.
+func (s *Service) processAgentJob(job jobs.Job) (err error) {
+	defer func() {
+		if err == nil {
+			if ackErr := s.queue.Ack(job.AgentID, job.ID); ackErr != nil {
+				fmt.Printf("pkg/services/job.processAgentJob(): there was an error acking job %s: %s\n", job.ID, ackErr)
 			}
-			switch job.Type {
-			case jobs.RESULT:
-				agent.Log(fmt.Sprintf("Results for job: %s", job.ID))
-
-				userMessage := messageAPI.UserMessage{
-					Level:   messageAPI.Note,
-					Time:    time.Now().UTC(),
-					Message: fmt.Sprintf("Results job %s for agent %s at %s", job.ID, job.AgentID, time.Now().UTC().Format(time.RFC3339)),
-				}
-				messageAPI.SendBroadcastMessage(userMessage)
-				result := job.Payload.(jobs.Results)
-				if len(result.Stdout) > 0 {
-					agent.Log(fmt.Sprintf("Command Results (stdout):\r\n%s", result.Stdout))
-					userMessage = messageAPI.UserMessage{
-						Level:   messageAPI.Success,
-						Time:    time.Now().UTC(),
-						Message: result.Stdout,
-					}
-					messageAPI.SendBroadcastMessage(userMessage)
-				}
-				if len(result.Stderr) > 0 {
-					agent.Log(fmt.Sprintf("Command Results (stderr):\r\n%s", result.Stderr))
-					userMessage = messageAPI.UserMessage{
-						Level:   messageAPI.Warn,
-						Time:    time.Now().UTC(),
-						Message: result.Stderr,
-					}
-					messageAPI.SendBroadcastMessage(userMessage)
-				}
-			case jobs.AGENTINFO:
-				err = s.agentService.UpdateAgentInfo(job.AgentID, job.Payload.(messages.AgentInfo))
-				if err != nil {
-					return err
-				}
-				//agent.UpdateInfo(job.Payload.(messages.AgentInfo))
-			case jobs.FILETRANSFER:
-				err = s.fileTransfer(job.AgentID, job.Payload.(jobs.FileTransfer))
-				if err != nil {
-					return err
-				}
-			case jobs.SOCKS:
-				// Send to SOCKS client
-				socks.In(job)
+		} else {
+			if nackErr := s.queue.Nack(job.AgentID, job.ID); nackErr != nil {
+				fmt.Printf("pkg/services/job.processAgentJob(): there was an error nacking job %s: %s\n", job.ID, nackErr)
 			}
-			// Update Jobs Info structure
+		}
+	}()
 
-			if job.Type == jobs.SOCKS {
-				if job.Payload.(jobs.Socks).Close {
-					jobInfo.Complete()
-				} else {
-					jobInfo.Active()
-				}
-			} else {
-				jobInfo.Complete()
-			}
-			err = s.jobRepo.UpdateInfo(jobInfo)
-			if err != nil {
-				return fmt.Errorf("pkg/services/job.Handler(): %s", err)
+	if !s.agentService.Exist(job.AgentID) {
+		messageAPI.SendBroadcastMessage(messageAPI.UserMessage{
+			Level:   messageAPI.Warn,
+			Time:    time.Now().UTC(),
+			Message: fmt.Sprintf("Job %s was for an invalid agent %s", job.ID, job.AgentID),
+		})
+		return nil
+	}
+
+	agent, err := s.agentService.Agent(job.AgentID)
+	if err != nil {
+		return err
+	}
+
+	// Get the job info structure
+	jobInfo, err := s.jobRepo.GetInfo(job.ID)
+	if err != nil {
+		return fmt.Errorf("pkg/services/job.processAgentJob(): %s", err)
+	}
+
+	// Verify that the job contains the correct token and that it was not already completed
+	err = s.checkJob(job)
+	if err != nil {
+		// Agent will send back error messages that are not the result of a job
+		if job.Type != jobs.RESULT {
+			return err
+		}
+		if core.Debug {
+			fmt.Printf("Received %s message without job token: %s\n", messages.String(job.Type), err)
+		}
+	}
+
+	var resultStreamComplete bool
+	var fileTransferComplete bool
+	switch job.Type {
+	case jobs.RESULT:
+		agent.Log(fmt.Sprintf("Results for job: %s", job.ID))
+
+		userMessage := messageAPI.UserMessage{
+			Level:   messageAPI.Note,
+			Time:    time.Now().UTC(),
+			Message: fmt.Sprintf("Results job %s for agent %s at %s", job.ID, job.AgentID, time.Now().UTC().Format(time.RFC3339)),
+		}
+		messageAPI.SendBroadcastMessage(userMessage)
+		result := job.Payload.(jobs.Results)
+		if len(result.Stdout) > 0 {
+			agent.Log(fmt.Sprintf("Command Results (stdout):\r\n%s", result.Stdout))
+			userMessage = messageAPI.UserMessage{
+				Level:   messageAPI.Success,
+				Time:    time.Now().UTC(),
+				Message: result.Stdout,
 			}
-		} else {
-			userMessage := messageAPI.UserMessage{
+			messageAPI.SendBroadcastMessage(userMessage)
+		}
+		if len(result.Stderr) > 0 {
+			agent.Log(fmt.Sprintf("Command Results (stderr):\r\n%s", result.Stderr))
+			userMessage = messageAPI.UserMessage{
 				Level:   messageAPI.Warn,
 				Time:    time.Now().UTC(),
-				Message: fmt.Sprintf("Job %s was for an invalid agent %s", job.ID, job.AgentID),
+				Message: result.Stderr,
 			}
 			messageAPI.SendBroadcastMessage(userMessage)
 		}
+		resultStreamComplete = s.bufferResult(job.ID, result)
+	case jobs.AGENTINFO:
+		err = s.agentService.UpdateAgentInfo(job.AgentID, job.Payload.(messages.AgentInfo))
+		if err != nil {
+			return err
+		}
+		//agent.UpdateInfo(job.Payload.(messages.AgentInfo))
+	case jobs.FILETRANSFER:
+		// Each chunk of a download from the agent shares the originating job's ID and Token, the same
+		// way a streamed RESULT does, so this job's Info record tracks the whole transfer rather than
+		// just one chunk; see transfer.go
+		fileTransferComplete, err = s.bufferFileTransferChunk(job.AgentID, job.Payload.(jobs.FileTransfer))
+		if err != nil {
+			return err
+		}
+	case jobs.FILETRANSFERCONTROL:
+		err = s.fileTransferControl(job.AgentID, job.Payload.(jobs.FileTransferControl))
+		if err != nil {
+			return err
+		}
+	case jobs.SOCKS:
+		// Send to the SOCKS client; UDP ASSOCIATE traffic is resequenced by connection Index the same
+		// way the TCP stream is, but rides its own payload type since a datagram has no ordered stream
+		// to append to
+		switch job.Payload.(type) {
+		case jobs.SocksUDP:
+			socks.InUDP(job)
+		default:
+			socks.In(job)
+		}
+	}
+
+	// Update Jobs Info structure. This terminal status write always happens last, after the handler
+	// above has fully returned without error, so an operator never observes COMPLETE before the work
+	// it represents (e.g. a fileTransfer flush) is actually durable.
+	if job.Type == jobs.SOCKS {
+		if socksClosed(job.Payload) {
+			jobInfo.Complete()
+		} else {
+			jobInfo.Active()
+		}
+	} else if job.Type == jobs.FILETRANSFER {
+		// Only transition to COMPLETE once every chunk has been staged and the manifest chunk's
+		// whole-file SHA-256 has verified against the assembled file; until then leave the job ACTIVE
+		// so GetTableActive shows the transfer progressing instead of appearing stuck
+		if fileTransferComplete {
+			jobInfo.Complete()
+		} else {
+			jobInfo.Active()
+		}
+	} else if job.Type == jobs.RESULT {
+		// Only transition to COMPLETE once the Final chunk has been delivered AND every lower
+		// sequence number has been observed, so a later chunk racing a prior "final" message
+		// across concurrent check-ins can't be attributed to an already-completed job
+		if resultStreamComplete {
+			jobInfo.Complete()
+		} else {
+			jobInfo.Active()
+		}
+	} else {
+		jobInfo.Complete()
+	}
+	err = s.jobRepo.UpdateInfo(jobInfo)
+	if err != nil {
+		return fmt.Errorf("pkg/services/job.processJob(): %s", err)
 	}
 	return nil
 }
@@ -896,4 +1227,4 @@ func (s *Service) socksJobs() {
 		}
 	}
 
-}
\ No newline at end of file
+}
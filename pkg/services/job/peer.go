@@ -0,0 +1,60 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package job
+
+import (
+	// Standard
+	"fmt"
+
+	// 3rd Party
+	uuid "github.com/satori/go.uuid"
+
+	// Internal
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+// routeJob prepares job for delivery to targetAgentID. If targetAgentID is directly connected to one of
+// the server's own listeners, job is returned unmodified. Otherwise job is wrapped in a jobs.LINK frame
+// addressed to the nearest ancestor agent the server can reach directly, carrying the full hop list so
+// each agent along the pivot chain can relay it one step further.
+func (s *Service) routeJob(targetAgentID uuid.UUID, job jobs.Job) jobs.Job {
+	nextHop, hops, direct := s.peers.Route(targetAgentID)
+	if direct {
+		return job
+	}
+
+	job.AgentID = targetAgentID
+	return jobs.Job{
+		ID:      job.ID,
+		Token:   job.Token,
+		AgentID: nextHop,
+		Type:    jobs.LINK,
+		Payload: jobs.Link{Hops: hops, Inner: job},
+	}
+}
+
+// unwrapLink strips a single jobs.LINK envelope off of job, returning the inner job addressed to its
+// true originating agent so it can be processed (or, if it is itself still wrapped, unwrapped again by
+// the caller)
+func (s *Service) unwrapLink(job jobs.Job) (jobs.Job, error) {
+	link, ok := job.Payload.(jobs.Link)
+	if !ok {
+		return jobs.Job{}, fmt.Errorf("pkg/services/job.unwrapLink(): job %s was typed LINK but did not carry a jobs.Link payload", job.ID)
+	}
+	return link.Inner, nil
+}
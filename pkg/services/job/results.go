@@ -0,0 +1,95 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package job
+
+import (
+	// Standard
+	"fmt"
+	"sync"
+	"time"
+
+	// Internal
+	messageAPI "github.com/Ne0nd0g/merlin/pkg/api/messages"
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+// resultStreamTimeout bounds how long the server waits for a missing lower-sequence chunk before
+// giving up on a streamed result and forcing the job to COMPLETE anyway, emitting a truncation warning
+const resultStreamTimeout = 5 * time.Minute
+
+// resultStream tracks the chunks seen so far for a single job's streamed RESULT messages (e.g. a
+// long-running shell or ssh session that sends chunked stdout across multiple check-ins)
+type resultStream struct {
+	seen     map[uint32]bool
+	final    bool
+	finalSeq uint32
+	start    time.Time
+}
+
+// resultStreams holds the in-flight resultStream for every job currently streaming chunked results,
+// keyed by job ID
+var resultStreams = struct {
+	sync.Mutex
+	m map[string]*resultStream
+}{m: make(map[string]*resultStream)}
+
+// bufferResult records a single chunk of a (possibly multi-part) job result and reports whether every
+// chunk up to and including the Final chunk has now been observed, in which case the caller should
+// transition the job to COMPLETE. Chunks that arrive out of order across concurrent check-ins are
+// buffered rather than completing the job prematurely.
+func (s *Service) bufferResult(jobID string, result jobs.Results) bool {
+	resultStreams.Lock()
+	defer resultStreams.Unlock()
+
+	stream, ok := resultStreams.m[jobID]
+	if !ok {
+		stream = &resultStream{seen: make(map[uint32]bool), start: time.Now().UTC()}
+		resultStreams.m[jobID] = stream
+	}
+	stream.seen[result.Sequence] = true
+	if result.Final {
+		stream.final = true
+		stream.finalSeq = result.Sequence
+	}
+
+	if stream.final {
+		complete := true
+		for i := uint32(0); i <= stream.finalSeq; i++ {
+			if !stream.seen[i] {
+				complete = false
+				break
+			}
+		}
+		if complete {
+			delete(resultStreams.m, jobID)
+			return true
+		}
+	}
+
+	if time.Since(stream.start) > resultStreamTimeout {
+		delete(resultStreams.m, jobID)
+		messageAPI.SendBroadcastMessage(messageAPI.UserMessage{
+			Level:   messageAPI.Warn,
+			Time:    time.Now().UTC(),
+			Message: fmt.Sprintf("Results for job %s were truncated; a chunk never arrived within %s", jobID, resultStreamTimeout),
+		})
+		return true
+	}
+
+	return false
+}
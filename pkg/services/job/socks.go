@@ -0,0 +1,70 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package job
+
+import (
+	// Standard
+	"fmt"
+	"time"
+
+	// Internal
+	messageAPI "github.com/Ne0nd0g/merlin/pkg/api/messages"
+	cli "github.com/Ne0nd0g/merlin/pkg/cli/core"
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+	"github.com/Ne0nd0g/merlin/pkg/modules/socks"
+)
+
+// socksUDPJobs is a goroutine, the UDP ASSOCIATE counterpart to socksJobs, that drains datagrams a SOCKS
+// server relayed in from a client over an established association and queues them as jobs.SocksUDP jobs
+// for the agent. That SOCKS server is responsible for accepting the ASSOCIATE request, resequencing the
+// agent's replies by Index, writing them back to the client's *net.UDPAddr, and tearing the association
+// down when its owning TCP control connection closes.
+//
+// UDP ASSOCIATE is not implemented end-to-end in this repository: this goroutine is only the
+// server-side job-dispatch half. pkg/servers/socks (the SOCKS server described above) and
+// pkg/modules/socks (the socks.JobsOutUDP/socks.InUDP integration points this half depends on) do not
+// exist anywhere in this tree, so in practice this goroutine blocks forever on an empty channel. It logs
+// once on startup to make that gap visible rather than silently doing nothing.
+func (s *Service) socksUDPJobs() {
+	messageAPI.SendBroadcastMessage(messageAPI.UserMessage{
+		Level:   messageAPI.Warn,
+		Time:    time.Now().UTC(),
+		Message: "SOCKS5 UDP ASSOCIATE is not available in this build: pkg/servers/socks and pkg/modules/socks are not present, so no traffic will ever arrive on this path",
+	})
+	for {
+		job := <-socks.JobsOutUDP
+		err := s.buildJob(job.AgentID, &job, nil)
+		if err != nil {
+			msg := messageAPI.ErrorMessage(fmt.Sprintf("there was an error creating a job for SOCKS UDP traffic to the agent: %s", err))
+			cli.MessageChannel <- msg
+		}
+	}
+}
+
+// socksClosed reports whether a SOCKS job's payload, TCP or UDP, signaled the end of its connection or
+// association
+func socksClosed(payload interface{}) bool {
+	switch p := payload.(type) {
+	case jobs.SocksUDP:
+		return p.Close
+	case jobs.Socks:
+		return p.Close
+	default:
+		return false
+	}
+}
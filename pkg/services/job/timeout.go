@@ -0,0 +1,160 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package job
+
+import (
+	// Standard
+	"fmt"
+	"time"
+
+	// 3rd Party
+	uuid "github.com/satori/go.uuid"
+
+	// Internal
+	messageAPI "github.com/Ne0nd0g/merlin/pkg/api/messages"
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+// defaultTimeoutSweepInterval is how often expireJobs scans the repository for SENT jobs that have
+// outlived their Timeout
+const defaultTimeoutSweepInterval = 30 * time.Second
+
+// defaultTimeout maps a jobType to how long a job may sit SENT before it is considered abandoned and
+// transitioned to EXPIRED; jobs not listed here use defaultTimeoutFallback
+var defaultTimeout = map[string]time.Duration{
+	"agentInfo": time.Minute,
+	"ifconfig":  time.Minute,
+	"pwd":       time.Minute,
+	"Minidump":  time.Hour,
+	"upload":    time.Hour,
+	"download":  time.Hour,
+}
+
+// defaultTimeoutFallback is used for any jobType not explicitly listed in defaultTimeout
+const defaultTimeoutFallback = 10 * time.Minute
+
+// defaultSweepInterval is how often sweepCompletedJobs scans the repository for old terminal jobs
+const defaultSweepInterval = time.Hour
+
+// defaultSweepRetention is how long a job is kept around after reaching a terminal status
+// (COMPLETE, CANCELED, or EXPIRED) before sweepCompletedJobs removes it. This is deliberately much
+// longer than any job Timeout so an operator still has time to review a job's result before it is
+// swept out of the repository.
+const defaultSweepRetention = 7 * 24 * time.Hour
+
+// timeoutFor returns the default Timeout duration a job of the given jobType should be queued with
+func timeoutFor(jobType string) time.Duration {
+	if d, ok := defaultTimeout[jobType]; ok {
+		return d
+	}
+	return defaultTimeoutFallback
+}
+
+// expireJobs is a goroutine that periodically scans every known job and transitions any job still SENT
+// past Sent+Timeout into EXPIRED, broadcasting a warning to operators. Jobs with an opt-in RetryPolicy
+// for an idempotent CONTROL or NATIVE job type are automatically re-queued after the policy's backoff,
+// up to MaxAttempts.
+func (s *Service) expireJobs() {
+	ticker := time.NewTicker(defaultTimeoutSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		now := time.Now().UTC()
+		for id, info := range s.jobRepo.GetAll() {
+			if info.Status() != jobs.SENT {
+				continue
+			}
+			if info.Timeout() <= 0 || now.Before(info.Sent().Add(info.Timeout())) {
+				continue
+			}
+
+			info.Expire()
+			if err := s.jobRepo.UpdateInfo(info); err != nil {
+				messageAPI.SendBroadcastMessage(messageAPI.UserMessage{
+					Level:   messageAPI.Warn,
+					Time:    now,
+					Message: fmt.Sprintf("there was an error expiring job %s: %s", id, err),
+				})
+				continue
+			}
+
+			messageAPI.SendBroadcastMessage(messageAPI.UserMessage{
+				Level:   messageAPI.Warn,
+				Time:    now,
+				Message: fmt.Sprintf("Job %s for agent %s expired after it was SENT on %s without a response", id, info.AgentID(), info.Sent()),
+			})
+
+			s.maybeRetry(id, info)
+		}
+	}
+}
+
+// sweepCompletedJobs is a goroutine that periodically removes jobs that have sat in a terminal status
+// (COMPLETE, CANCELED, or EXPIRED) for longer than defaultSweepRetention, so the repository does not
+// grow without bound over the life of a long-running engagement.
+func (s *Service) sweepCompletedJobs() {
+	ticker := time.NewTicker(defaultSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		before := time.Now().UTC().Add(-defaultSweepRetention)
+		removed, err := s.jobRepo.RemoveCompleted(before)
+		if err != nil {
+			messageAPI.SendBroadcastMessage(messageAPI.UserMessage{
+				Level:   messageAPI.Warn,
+				Time:    time.Now().UTC(),
+				Message: fmt.Sprintf("there was an error sweeping completed jobs: %s", err),
+			})
+			continue
+		}
+		if removed > 0 {
+			messageAPI.SendBroadcastMessage(messageAPI.UserMessage{
+				Level:   messageAPI.Info,
+				Time:    time.Now().UTC(),
+				Message: fmt.Sprintf("Swept %d job(s) older than %s", removed, defaultSweepRetention),
+			})
+		}
+	}
+}
+
+// maybeRetry re-queues an EXPIRED job if it carries a RetryPolicy, is an idempotent CONTROL/NATIVE job,
+// and has not yet exhausted MaxAttempts
+func (s *Service) maybeRetry(id string, info jobs.Info) {
+	policy := info.Retry()
+	if policy.MaxAttempts <= 0 {
+		return
+	}
+	if info.Type() != jobs.String(jobs.CONTROL) && info.Type() != jobs.String(jobs.NATIVE) {
+		return
+	}
+	if info.Attempts() >= policy.MaxAttempts {
+		return
+	}
+
+	time.AfterFunc(policy.Backoff, func() {
+		job, err := s.jobRepo.GetJob(id)
+		if err != nil {
+			return
+		}
+		// Clear the expired job's ID/Token so buildJob's "SOCKS jobs keep their own ID/Token" branch
+		// does not carry them over; the retry needs a fresh ID/Token of its own, since the agent's
+		// eventual response can only ever be checked against the record it was actually dispatched
+		// and tracked under
+		job.ID = ""
+		job.Token = uuid.Nil
+		_ = s.buildJob(info.AgentID(), &job, nil)
+	})
+}
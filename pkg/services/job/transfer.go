@@ -0,0 +1,317 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package job
+
+import (
+	// Standard
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	// 3rd Party
+	uuid "github.com/satori/go.uuid"
+
+	// Internal
+	messageAPI "github.com/Ne0nd0g/merlin/pkg/api/messages"
+	"github.com/Ne0nd0g/merlin/pkg/core"
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+// fileTransferStagingDir is where chunks of an in-flight download from an agent are staged, keyed by
+// TransferID, until every chunk has arrived and the assembled file has passed its SHA-256 check
+const fileTransferStagingDir = "transfers"
+
+// fileTransfer tracks the chunks received so far for a single chunked FILETRANSFER, keyed by its
+// TransferID. A chunk that arrives out of order, or after the agent reconnects mid-transfer, is placed
+// by ChunkIndex rather than appended, so the transfer resumes instead of restarting from scratch.
+type fileTransfer struct {
+	agentID     uuid.UUID
+	location    string
+	stagingDir  string
+	totalChunks int
+	sha256      string // whole-file SHA-256 from the manifest chunk; empty until it arrives
+	received    map[int]bool
+}
+
+// fileTransfers holds the in-flight fileTransfer state for every TransferID currently being received,
+// the same way resultStreams tracks in-flight streamed RESULT messages
+var fileTransfers = struct {
+	sync.Mutex
+	m map[string]*fileTransfer
+}{m: make(map[string]*fileTransfer)}
+
+// chunkPath returns where the given 0-indexed data chunk is staged on disk for this transfer
+func (t *fileTransfer) chunkPath(index int) string {
+	return filepath.Join(t.stagingDir, strconv.Itoa(index)+".chunk")
+}
+
+// percentComplete returns how much of the transfer, by chunk count, has been staged so far
+func (t *fileTransfer) percentComplete() int {
+	if t.totalChunks <= 0 {
+		return 0
+	}
+	return len(t.received) * 100 / t.totalChunks
+}
+
+// bufferFileTransferChunk stages a single FILETRANSFER chunk - either a data chunk (verified against its
+// own ChunkSHA256) or the final manifest chunk (carrying the whole-file SHA256 and no blob of its own) -
+// and reports whether the transfer is now complete, in which case the caller should transition the job
+// to COMPLETE. Every chunk of a given transfer must share the same TransferID.
+func (s *Service) bufferFileTransferChunk(agentID uuid.UUID, p jobs.FileTransfer) (bool, error) {
+	if !s.agentService.Exist(agentID) {
+		return false, fmt.Errorf("%s is not a valid agent", agentID)
+	}
+
+	t, err := s.fileTransferFor(agentID, p)
+	if err != nil {
+		return false, err
+	}
+
+	// The manifest chunk carries the whole-file SHA-256 and no blob of its own
+	if p.SHA256 != "" {
+		t.sha256 = p.SHA256
+	} else if err = t.stageChunk(p); err != nil {
+		return false, err
+	}
+
+	messageAPI.SendBroadcastMessage(messageAPI.UserMessage{
+		Level:   messageAPI.Note,
+		Time:    time.Now().UTC(),
+		Message: fmt.Sprintf("Transfer %s for agent %s: %d%% (%d/%d chunks)", p.TransferID, agentID, t.percentComplete(), len(t.received), t.totalChunks),
+	})
+
+	if t.sha256 == "" || len(t.received) < t.totalChunks {
+		return false, nil
+	}
+
+	if err = s.assembleFileTransfer(p.TransferID, t); err != nil {
+		return false, err
+	}
+
+	fileTransfers.Lock()
+	delete(fileTransfers.m, p.TransferID)
+	fileTransfers.Unlock()
+	return true, nil
+}
+
+// validTransferID reports whether id is safe to use as a single path element - i.e. it is not empty,
+// contains no path separators, and isn't a "." or ".." traversal segment. TransferID is agent-supplied
+// and gets joined directly into a filesystem path, so anything else must be rejected before that join.
+func validTransferID(id string) bool {
+	if id == "" || id != filepath.Base(id) {
+		return false
+	}
+	return id != "." && id != ".."
+}
+
+// fileTransferFor returns the in-flight fileTransfer for p.TransferID, creating its staging directory
+// and tracking entry on the first chunk seen for a given TransferID. It returns an error if another
+// agent already owns that TransferID, since transfers are scoped by (agentID, TransferID).
+func (s *Service) fileTransferFor(agentID uuid.UUID, p jobs.FileTransfer) (*fileTransfer, error) {
+	if !validTransferID(p.TransferID) {
+		return nil, fmt.Errorf("pkg/services/job.fileTransferFor(): invalid TransferID %q", p.TransferID)
+	}
+
+	fileTransfers.Lock()
+	defer fileTransfers.Unlock()
+
+	t, ok := fileTransfers.m[p.TransferID]
+	if ok {
+		if t.agentID != agentID {
+			return nil, fmt.Errorf("pkg/services/job.fileTransferFor(): transfer %s does not belong to agent %s", p.TransferID, agentID)
+		}
+		return t, nil
+	}
+
+	dir := filepath.Join(core.CurrentDir, "data", "agents", agentID.String(), fileTransferStagingDir, p.TransferID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("pkg/services/job.fileTransferFor(): there was an error creating the staging directory for transfer %s: %s", p.TransferID, err)
+	}
+	t = &fileTransfer{
+		agentID:     agentID,
+		location:    p.FileLocation,
+		stagingDir:  dir,
+		totalChunks: p.TotalChunks,
+		received:    make(map[int]bool),
+	}
+	fileTransfers.m[p.TransferID] = t
+	return t, nil
+}
+
+// stageChunk decodes, optionally decompresses, and verifies a single data chunk's SHA-256 before
+// writing it to its position in the staging directory
+func (t *fileTransfer) stageChunk(p jobs.FileTransfer) error {
+	blob, err := base64.StdEncoding.DecodeString(p.FileBlob)
+	if err != nil {
+		return fmt.Errorf("pkg/services/job.stageChunk(): there was an error decoding chunk %d of transfer %s: %s", p.ChunkIndex, p.TransferID, err)
+	}
+
+	if p.Compressed {
+		zr, errZlib := zlib.NewReader(bytes.NewReader(blob))
+		if errZlib != nil {
+			return fmt.Errorf("pkg/services/job.stageChunk(): there was an error decompressing chunk %d of transfer %s: %s", p.ChunkIndex, p.TransferID, errZlib)
+		}
+		blob, err = ioutil.ReadAll(zr)
+		if err != nil {
+			return fmt.Errorf("pkg/services/job.stageChunk(): there was an error decompressing chunk %d of transfer %s: %s", p.ChunkIndex, p.TransferID, err)
+		}
+		_ = zr.Close()
+	}
+
+	sum := sha256.Sum256(blob)
+	if hex.EncodeToString(sum[:]) != p.ChunkSHA256 {
+		return fmt.Errorf("pkg/services/job.stageChunk(): chunk %d of transfer %s failed its SHA-256 check", p.ChunkIndex, p.TransferID)
+	}
+
+	if err = ioutil.WriteFile(t.chunkPath(p.ChunkIndex), blob, 0600); err != nil {
+		return fmt.Errorf("pkg/services/job.stageChunk(): there was an error staging chunk %d of transfer %s: %s", p.ChunkIndex, p.TransferID, err)
+	}
+	t.received[p.ChunkIndex] = true
+	return nil
+}
+
+// assembleFileTransfer concatenates every staged chunk, in order, into the agent's data directory,
+// verifies the result against the manifest's whole-file SHA-256, and removes the staging directory
+func (s *Service) assembleFileTransfer(transferID string, t *fileTransfer) error {
+	agentsDir := filepath.Join(core.CurrentDir, "data", "agents", t.agentID.String())
+	if _, err := os.Stat(agentsDir); os.IsNotExist(err) {
+		return fmt.Errorf("pkg/services/job.assembleFileTransfer(): there was an error locating the agent's directory:\r\n%s", err)
+	}
+	_, name := filepath.Split(t.location) // We don't need the directory part for anything
+	destination := filepath.Join(agentsDir, name)
+
+	out, err := os.OpenFile(destination, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("pkg/services/job.assembleFileTransfer(): there was an error creating %s: %s", destination, err)
+	}
+	defer out.Close()
+
+	hasher := sha256.New()
+	w := io.MultiWriter(out, hasher)
+	var size int64
+	for i := 0; i < t.totalChunks; i++ {
+		chunk, errRead := ioutil.ReadFile(t.chunkPath(i))
+		if errRead != nil {
+			return fmt.Errorf("pkg/services/job.assembleFileTransfer(): there was an error reading staged chunk %d of transfer %s: %s", i, transferID, errRead)
+		}
+		n, errWrite := w.Write(chunk)
+		if errWrite != nil {
+			return fmt.Errorf("pkg/services/job.assembleFileTransfer(): there was an error assembling transfer %s: %s", transferID, errWrite)
+		}
+		size += int64(n)
+	}
+
+	if sum := hex.EncodeToString(hasher.Sum(nil)); sum != t.sha256 {
+		_ = out.Close()
+		_ = os.Remove(destination)
+		return fmt.Errorf("pkg/services/job.assembleFileTransfer(): assembled file for transfer %s failed its whole-file SHA-256 check, expected %s got %s", transferID, t.sha256, sum)
+	}
+
+	_ = os.RemoveAll(t.stagingDir)
+
+	successMessage := fmt.Sprintf("Successfully downloaded file %s with a size of %d bytes from agent %s to %s", t.location, size, t.agentID, destination)
+	messageAPI.SendBroadcastMessage(messageAPI.UserMessage{
+		Level:   messageAPI.Success,
+		Time:    time.Now().UTC(),
+		Message: successMessage,
+	})
+	return s.agentService.Log(t.agentID, successMessage)
+}
+
+// fileTransferControl handles an agent's in-band control message for a chunked file transfer: a resume
+// probe sent after reconnecting mid-transfer, answered with the bitmap of chunks still missing so only
+// those are re-sent, or a cancel/abort that discards any chunks staged so far.
+func (s *Service) fileTransferControl(agentID uuid.UUID, p jobs.FileTransferControl) error {
+	switch strings.ToLower(p.Action) {
+	case "resume":
+		missing, err := s.missingFileTransferChunks(agentID, p.TransferID)
+		if err != nil {
+			return err
+		}
+		reply := &jobs.Job{
+			Type: jobs.FILETRANSFERCONTROL,
+			Payload: jobs.FileTransferControl{
+				TransferID: p.TransferID,
+				Action:     "resume",
+				Missing:    missing,
+			},
+		}
+		return s.buildJob(agentID, reply, nil)
+	case "cancel", "abort":
+		if err := s.cancelFileTransfer(agentID, p.TransferID); err != nil {
+			return err
+		}
+		return s.agentService.Log(agentID, fmt.Sprintf("Transfer %s canceled by agent request", p.TransferID))
+	default:
+		return fmt.Errorf("pkg/services/job.fileTransferControl(): unknown action %q for transfer %s", p.Action, p.TransferID)
+	}
+}
+
+// missingFileTransferChunks returns the indices, in order, of every data chunk not yet staged for
+// transferID, or nil if the transfer isn't currently tracked (e.g. it already completed). It returns an
+// error if transferID is tracked but belongs to a different agent, so one agent can't probe another's
+// in-flight transfer by guessing its TransferID.
+func (s *Service) missingFileTransferChunks(agentID uuid.UUID, transferID string) ([]int, error) {
+	fileTransfers.Lock()
+	defer fileTransfers.Unlock()
+
+	t, ok := fileTransfers.m[transferID]
+	if !ok {
+		return nil, nil
+	}
+	if t.agentID != agentID {
+		return nil, fmt.Errorf("pkg/services/job.missingFileTransferChunks(): transfer %s does not belong to agent %s", transferID, agentID)
+	}
+	var missing []int
+	for i := 0; i < t.totalChunks; i++ {
+		if !t.received[i] {
+			missing = append(missing, i)
+		}
+	}
+	return missing, nil
+}
+
+// cancelFileTransfer stops tracking transferID and removes any chunks already staged for it. It returns
+// an error if transferID is tracked but belongs to a different agent, so one agent can't cancel
+// another's in-flight transfer by guessing its TransferID.
+func (s *Service) cancelFileTransfer(agentID uuid.UUID, transferID string) error {
+	fileTransfers.Lock()
+	t, ok := fileTransfers.m[transferID]
+	if ok && t.agentID != agentID {
+		fileTransfers.Unlock()
+		return fmt.Errorf("pkg/services/job.cancelFileTransfer(): transfer %s does not belong to agent %s", transferID, agentID)
+	}
+	delete(fileTransfers.m, transferID)
+	fileTransfers.Unlock()
+
+	if ok {
+		_ = os.RemoveAll(t.stagingDir)
+	}
+	return nil
+}
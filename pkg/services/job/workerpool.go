@@ -0,0 +1,82 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package job
+
+import (
+	// Standard
+	"sync"
+
+	// 3rd Party
+	uuid "github.com/satori/go.uuid"
+
+	// Internal
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+// workItem is a single job queued to an agentWorker, along with the plumbing Handler needs to learn
+// the outcome once the worker has processed it
+type workItem struct {
+	job  jobs.Job
+	wg   *sync.WaitGroup
+	errs chan<- error
+}
+
+// workerQueueSize bounds how many jobs may be queued to a single agent's worker before dispatch blocks;
+// a single agent check-in rarely returns more jobs than this
+const workerQueueSize = 64
+
+// dispatch hands a job to the worker responsible for its AgentID, starting that worker if it does not
+// already exist. Jobs handed to the same agent's worker are processed one at a time, in the order
+// dispatch was called, while other agents' workers run concurrently.
+func (s *Service) dispatch(job jobs.Job, wg *sync.WaitGroup, errs chan<- error) {
+	s.workerFor(job.AgentID) <- workItem{job: job, wg: wg, errs: errs}
+}
+
+// workerFor returns the worker channel for agentID, starting a new agentWorker goroutine the first
+// time a given agent is seen
+func (s *Service) workerFor(agentID uuid.UUID) chan workItem {
+	s.workersMu.Lock()
+	defer s.workersMu.Unlock()
+
+	if s.workers == nil {
+		s.workers = make(map[uuid.UUID]chan workItem)
+	}
+	ch, ok := s.workers[agentID]
+	if !ok {
+		ch = make(chan workItem, workerQueueSize)
+		s.workers[agentID] = ch
+		go s.agentWorker(ch)
+	}
+	return ch
+}
+
+// agentWorker drains ch in order for as long as the Service exists, guaranteeing that one agent's slow
+// job (e.g. a large FILETRANSFER) never delays the processing of another agent's jobs, which are routed
+// to their own worker's channel instead
+func (s *Service) agentWorker(ch chan workItem) {
+	process := s.processJob
+	if s.testProcessJob != nil {
+		process = s.testProcessJob
+	}
+	for item := range ch {
+		if err := process(item.job); err != nil {
+			item.errs <- err
+		}
+		item.wg.Done()
+	}
+}
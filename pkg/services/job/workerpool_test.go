@@ -0,0 +1,129 @@
+// Merlin is a post-exploitation command and control framework.
+// This file is part of Merlin.
+// Copyright (C) 2022  Russel Van Tuyl
+
+// Merlin is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// any later version.
+
+// Merlin is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+
+// You should have received a copy of the GNU General Public License
+// along with Merlin.  If not, see <http://www.gnu.org/licenses/>.
+
+package job
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	uuid "github.com/satori/go.uuid"
+
+	"github.com/Ne0nd0g/merlin/pkg/jobs"
+)
+
+// TestWorkerForSameAgentSameChannel verifies that every job for a given agent is routed to the same
+// worker channel, which is what guarantees that agent's jobs are processed in order.
+func TestWorkerForSameAgentSameChannel(t *testing.T) {
+	s := &Service{}
+	agentID := uuid.NewV4()
+
+	first := s.workerFor(agentID)
+	second := s.workerFor(agentID)
+
+	if first != second {
+		t.Fatalf("workerFor returned different channels for the same agent ID")
+	}
+}
+
+// TestWorkerForDistinctAgentsDistinctChannels verifies that different agents are routed to independent
+// worker channels, which is what lets one agent's slow job proceed without blocking another agent's jobs.
+func TestWorkerForDistinctAgentsDistinctChannels(t *testing.T) {
+	s := &Service{}
+	agentOne := uuid.NewV4()
+	agentTwo := uuid.NewV4()
+
+	chOne := s.workerFor(agentOne)
+	chTwo := s.workerFor(agentTwo)
+
+	if chOne == chTwo {
+		t.Fatalf("workerFor returned the same channel for two distinct agent IDs")
+	}
+}
+
+// TestDispatchSlowFileTransferDoesNotBlockOtherAgents verifies the two guarantees agentWorker exists to
+// provide: a slow FILETRANSFER queued for one agent does not delay a concurrently dispatched job for a
+// different agent, and the caller never observes a job as finished until its handler has actually
+// returned (i.e. nothing short-circuits wg.Done() ahead of the slow handler completing).
+func TestDispatchSlowFileTransferDoesNotBlockOtherAgents(t *testing.T) {
+	s := &Service{}
+
+	const slowJobDelay = 100 * time.Millisecond
+
+	var mu sync.Mutex
+	var completedOrder []string
+	s.testProcessJob = func(j jobs.Job) error {
+		if j.Type == jobs.FILETRANSFER {
+			time.Sleep(slowJobDelay)
+		}
+		mu.Lock()
+		completedOrder = append(completedOrder, j.ID)
+		mu.Unlock()
+		return nil
+	}
+
+	slowJob := jobs.Job{ID: "slow", AgentID: uuid.NewV4(), Type: jobs.FILETRANSFER}
+	fastJob := jobs.Job{ID: "fast", AgentID: uuid.NewV4(), Type: jobs.CONTROL}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	wg.Add(2)
+
+	start := time.Now()
+	s.dispatch(slowJob, &wg, errs)
+	s.dispatch(fastJob, &wg, errs)
+
+	fastDone := make(chan struct{})
+	go func() {
+		for {
+			mu.Lock()
+			for _, id := range completedOrder {
+				if id == "fast" {
+					mu.Unlock()
+					close(fastDone)
+					return
+				}
+			}
+			mu.Unlock()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	select {
+	case <-fastDone:
+		if elapsed := time.Since(start); elapsed >= slowJobDelay {
+			t.Fatalf("fast job for a distinct agent was delayed by the slow job: took %s", elapsed)
+		}
+	case <-time.After(slowJobDelay):
+		t.Fatal("fast job for a distinct agent never completed; it appears to be stuck behind the slow job")
+	}
+
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("unexpected error from agentWorker: %s", err)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(completedOrder) != 2 || completedOrder[0] != "fast" || completedOrder[1] != "slow" {
+		t.Fatalf("expected the fast job to be marked done before the slow job's handler returned, got order: %v", completedOrder)
+	}
+}